@@ -0,0 +1,17 @@
+-- migrate:up
+
+CREATE TABLE gc_roots (
+    id SERIAL PRIMARY KEY NOT NULL,
+    github_user TEXT NOT NULL,
+    name TEXT NOT NULL,
+    path INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    UNIQUE (github_user, name),
+    FOREIGN KEY (path) REFERENCES valid_paths(id) ON DELETE RESTRICT
+);
+
+CREATE INDEX index_gc_roots_path ON gc_roots(path);
+
+-- migrate:down
+
+DROP TABLE gc_roots;
@@ -0,0 +1,26 @@
+-- migrate:up
+
+-- Every protocol session holds on to one database connection for its whole
+-- lifetime. If the session crashes, the backend goes away and its temporary
+-- roots stop counting even before the row is cleaned up.
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY NOT NULL,
+    github_user TEXT,
+    backend_pid INTEGER NOT NULL,
+    backend_start TIMESTAMP WITH TIME ZONE NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE TABLE temp_roots (
+    session INTEGER NOT NULL,
+    path TEXT NOT NULL, -- not necessarily valid yet, e.g. during an upload
+    PRIMARY KEY (session, path),
+    FOREIGN KEY (session) REFERENCES sessions(id) ON DELETE CASCADE
+);
+
+CREATE INDEX index_temp_roots_path ON temp_roots(path);
+
+-- migrate:down
+
+DROP TABLE temp_roots;
+DROP TABLE sessions;
@@ -0,0 +1,9 @@
+-- migrate:up
+
+ALTER TABLE valid_paths ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY;
+ALTER TABLE valid_paths ALTER COLUMN nar_size TYPE BIGINT;
+
+-- migrate:down
+
+ALTER TABLE valid_paths ALTER COLUMN nar_size TYPE INTEGER;
+ALTER TABLE valid_paths ALTER COLUMN id DROP IDENTITY;
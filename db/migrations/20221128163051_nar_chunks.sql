@@ -0,0 +1,24 @@
+-- migrate:up
+
+CREATE TABLE chunks (
+    hash TEXT PRIMARY KEY NOT NULL,
+    size INTEGER NOT NULL
+);
+
+-- NARs moved into chunks by OptimiseStore; NARs without rows here are stored
+-- as a single blob.
+CREATE TABLE nar_chunks (
+    nar_hash TEXT NOT NULL,
+    seq INTEGER NOT NULL,
+    chunk TEXT NOT NULL,
+    nar_offset BIGINT NOT NULL,
+    PRIMARY KEY (nar_hash, seq),
+    FOREIGN KEY (chunk) REFERENCES chunks(hash) ON DELETE RESTRICT
+);
+
+CREATE INDEX index_nar_chunks_chunk ON nar_chunks(chunk);
+
+-- migrate:down
+
+DROP TABLE nar_chunks;
+DROP TABLE chunks;
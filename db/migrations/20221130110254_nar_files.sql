@@ -0,0 +1,21 @@
+-- migrate:up
+
+-- The NAR file as stored, like FileHash, FileSize and Compression in a
+-- narinfo. Existing NARs are uncompressed, so their file is the NAR itself.
+ALTER TABLE valid_paths
+    ADD COLUMN file_hash TEXT,
+    ADD COLUMN file_size BIGINT,
+    ADD COLUMN compression TEXT NOT NULL DEFAULT 'none';
+
+UPDATE valid_paths SET file_hash = hash, file_size = nar_size;
+
+CREATE INDEX index_valid_paths_file_hash ON valid_paths(file_hash);
+
+-- migrate:down
+
+DROP INDEX index_valid_paths_file_hash;
+
+ALTER TABLE valid_paths
+    DROP COLUMN compression,
+    DROP COLUMN file_size,
+    DROP COLUMN file_hash;
@@ -0,0 +1,12 @@
+-- migrate:up
+
+-- NAR files uploaded to the HTTP binary cache, waiting for their narinfo.
+CREATE TABLE uploads (
+    key TEXT PRIMARY KEY NOT NULL,
+    uploader TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+-- migrate:down
+
+DROP TABLE uploads;
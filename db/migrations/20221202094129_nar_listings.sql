@@ -0,0 +1,11 @@
+-- migrate:up
+
+-- The .ls listing of each NAR, built while it's added.
+CREATE TABLE nar_listings (
+    nar_hash TEXT PRIMARY KEY NOT NULL,
+    listing JSONB NOT NULL
+);
+
+-- migrate:down
+
+DROP TABLE nar_listings;
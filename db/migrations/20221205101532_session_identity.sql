@@ -0,0 +1,10 @@
+-- migrate:up
+
+-- Who a session authenticated as, beyond the Github user.
+ALTER TABLE sessions ADD COLUMN ssh_user TEXT;
+ALTER TABLE sessions ADD COLUMN key_fingerprint TEXT;
+
+-- migrate:down
+
+ALTER TABLE sessions DROP COLUMN key_fingerprint;
+ALTER TABLE sessions DROP COLUMN ssh_user;
@@ -0,0 +1,11 @@
+-- migrate:up
+
+-- Narinfo lookups and reference scans look paths up by their hash part, which
+-- LIKE can't use the unique index on path for under most collations.
+ALTER TABLE valid_paths ADD COLUMN hash_part TEXT GENERATED ALWAYS AS (substring(path from 12 for 32)) STORED;
+CREATE INDEX index_valid_paths_hash_part ON valid_paths (hash_part);
+
+-- migrate:down
+
+DROP INDEX index_valid_paths_hash_part;
+ALTER TABLE valid_paths DROP COLUMN hash_part;
@@ -0,0 +1,17 @@
+-- migrate:up
+
+-- NARs stored for paths that aren't valid yet. They count as used, so they
+-- aren't deleted from under the upload, until the paths are registered or
+-- the upload is abandoned.
+CREATE TABLE staged_nars (
+    id SERIAL PRIMARY KEY NOT NULL,
+    nar_hash TEXT NOT NULL,
+    compression TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX index_staged_nars_nar_hash ON staged_nars(nar_hash);
+
+-- migrate:down
+
+DROP TABLE staged_nars;
@@ -20,6 +20,16 @@ SET default_tablespace = '';
 
 SET default_table_access_method = heap;
 
+--
+-- Name: chunks; Type: TABLE; Schema: manveru; Owner: -
+--
+
+CREATE TABLE manveru.chunks (
+    hash text NOT NULL,
+    size integer NOT NULL
+);
+
+
 --
 -- Name: derivation_outputs; Type: TABLE; Schema: manveru; Owner: -
 --
@@ -31,6 +41,51 @@ CREATE TABLE manveru.derivation_outputs (
 );
 
 
+--
+-- Name: gc_roots; Type: TABLE; Schema: manveru; Owner: -
+--
+
+CREATE TABLE manveru.gc_roots (
+    id integer NOT NULL,
+    github_user text NOT NULL,
+    name text NOT NULL,
+    path integer NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+--
+-- Name: gc_roots_id_seq; Type: SEQUENCE; Schema: manveru; Owner: -
+--
+
+CREATE SEQUENCE manveru.gc_roots_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: gc_roots_id_seq; Type: SEQUENCE OWNED BY; Schema: manveru; Owner: -
+--
+
+ALTER SEQUENCE manveru.gc_roots_id_seq OWNED BY manveru.gc_roots.id;
+
+
+--
+-- Name: nar_chunks; Type: TABLE; Schema: manveru; Owner: -
+--
+
+CREATE TABLE manveru.nar_chunks (
+    nar_hash text NOT NULL,
+    seq integer NOT NULL,
+    chunk text NOT NULL,
+    nar_offset bigint NOT NULL
+);
+
+
 --
 -- Name: refs; Type: TABLE; Schema: manveru; Owner: -
 --
@@ -41,6 +96,16 @@ CREATE TABLE manveru.refs (
 );
 
 
+--
+-- Name: nar_listings; Type: TABLE; Schema: manveru; Owner: -
+--
+
+CREATE TABLE manveru.nar_listings (
+    nar_hash text NOT NULL,
+    listing jsonb NOT NULL
+);
+
+
 --
 -- Name: schema_migrations; Type: TABLE; Schema: manveru; Owner: -
 --
@@ -50,6 +115,94 @@ CREATE TABLE manveru.schema_migrations (
 );
 
 
+--
+-- Name: sessions; Type: TABLE; Schema: manveru; Owner: -
+--
+
+CREATE TABLE manveru.sessions (
+    id integer NOT NULL,
+    github_user text,
+    backend_pid integer NOT NULL,
+    backend_start timestamp with time zone NOT NULL,
+    started_at timestamp with time zone DEFAULT now() NOT NULL,
+    ssh_user text,
+    key_fingerprint text
+);
+
+
+--
+-- Name: sessions_id_seq; Type: SEQUENCE; Schema: manveru; Owner: -
+--
+
+CREATE SEQUENCE manveru.sessions_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: sessions_id_seq; Type: SEQUENCE OWNED BY; Schema: manveru; Owner: -
+--
+
+ALTER SEQUENCE manveru.sessions_id_seq OWNED BY manveru.sessions.id;
+
+
+--
+-- Name: staged_nars; Type: TABLE; Schema: manveru; Owner: -
+--
+
+CREATE TABLE manveru.staged_nars (
+    id integer NOT NULL,
+    nar_hash text NOT NULL,
+    compression text NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+--
+-- Name: staged_nars_id_seq; Type: SEQUENCE; Schema: manveru; Owner: -
+--
+
+CREATE SEQUENCE manveru.staged_nars_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: staged_nars_id_seq; Type: SEQUENCE OWNED BY; Schema: manveru; Owner: -
+--
+
+ALTER SEQUENCE manveru.staged_nars_id_seq OWNED BY manveru.staged_nars.id;
+
+
+--
+-- Name: temp_roots; Type: TABLE; Schema: manveru; Owner: -
+--
+
+CREATE TABLE manveru.temp_roots (
+    session integer NOT NULL,
+    path text NOT NULL
+);
+
+
+--
+-- Name: uploads; Type: TABLE; Schema: manveru; Owner: -
+--
+
+CREATE TABLE manveru.uploads (
+    key text NOT NULL,
+    uploader text NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
 --
 -- Name: valid_paths; Type: TABLE; Schema: manveru; Owner: -
 --
@@ -60,13 +213,60 @@ CREATE TABLE manveru.valid_paths (
     hash text NOT NULL,
     registration_time timestamp with time zone,
     deriver text,
-    nar_size integer,
+    nar_size bigint,
     ultimate boolean,
     sigs text[],
-    ca text
+    ca text,
+    file_hash text,
+    file_size bigint,
+    compression text DEFAULT 'none'::text NOT NULL,
+    hash_part text GENERATED ALWAYS AS ("substring"(path, 12, 32)) STORED
+);
+
+
+--
+-- Name: valid_paths_id_seq; Type: SEQUENCE; Schema: manveru; Owner: -
+--
+
+ALTER TABLE manveru.valid_paths ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY (
+    SEQUENCE NAME manveru.valid_paths_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
 );
 
 
+--
+-- Name: gc_roots id; Type: DEFAULT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.gc_roots ALTER COLUMN id SET DEFAULT nextval('manveru.gc_roots_id_seq'::regclass);
+
+
+--
+-- Name: sessions id; Type: DEFAULT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.sessions ALTER COLUMN id SET DEFAULT nextval('manveru.sessions_id_seq'::regclass);
+
+
+--
+-- Name: staged_nars id; Type: DEFAULT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.staged_nars ALTER COLUMN id SET DEFAULT nextval('manveru.staged_nars_id_seq'::regclass);
+
+
+--
+-- Name: chunks chunks_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.chunks
+    ADD CONSTRAINT chunks_pkey PRIMARY KEY (hash);
+
+
 --
 -- Name: derivation_outputs derivation_outputs_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
 --
@@ -75,6 +275,30 @@ ALTER TABLE ONLY manveru.derivation_outputs
     ADD CONSTRAINT derivation_outputs_pkey PRIMARY KEY (drv, id);
 
 
+--
+-- Name: gc_roots gc_roots_github_user_name_key; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.gc_roots
+    ADD CONSTRAINT gc_roots_github_user_name_key UNIQUE (github_user, name);
+
+
+--
+-- Name: gc_roots gc_roots_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.gc_roots
+    ADD CONSTRAINT gc_roots_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: nar_chunks nar_chunks_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.nar_chunks
+    ADD CONSTRAINT nar_chunks_pkey PRIMARY KEY (nar_hash, seq);
+
+
 --
 -- Name: refs refs_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
 --
@@ -83,6 +307,14 @@ ALTER TABLE ONLY manveru.refs
     ADD CONSTRAINT refs_pkey PRIMARY KEY (referrer, reference);
 
 
+--
+-- Name: nar_listings nar_listings_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.nar_listings
+    ADD CONSTRAINT nar_listings_pkey PRIMARY KEY (nar_hash);
+
+
 --
 -- Name: schema_migrations schema_migrations_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
 --
@@ -91,6 +323,38 @@ ALTER TABLE ONLY manveru.schema_migrations
     ADD CONSTRAINT schema_migrations_pkey PRIMARY KEY (version);
 
 
+--
+-- Name: sessions sessions_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.sessions
+    ADD CONSTRAINT sessions_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: staged_nars staged_nars_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.staged_nars
+    ADD CONSTRAINT staged_nars_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: temp_roots temp_roots_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.temp_roots
+    ADD CONSTRAINT temp_roots_pkey PRIMARY KEY (session, path);
+
+
+--
+-- Name: uploads uploads_pkey; Type: CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.uploads
+    ADD CONSTRAINT uploads_pkey PRIMARY KEY (key);
+
+
 --
 -- Name: valid_paths valid_paths_path_key; Type: CONSTRAINT; Schema: manveru; Owner: -
 --
@@ -114,6 +378,20 @@ ALTER TABLE ONLY manveru.valid_paths
 CREATE INDEX index_derivation_outputs ON manveru.derivation_outputs USING btree (path);
 
 
+--
+-- Name: index_gc_roots_path; Type: INDEX; Schema: manveru; Owner: -
+--
+
+CREATE INDEX index_gc_roots_path ON manveru.gc_roots USING btree (path);
+
+
+--
+-- Name: index_nar_chunks_chunk; Type: INDEX; Schema: manveru; Owner: -
+--
+
+CREATE INDEX index_nar_chunks_chunk ON manveru.nar_chunks USING btree (chunk);
+
+
 --
 -- Name: index_reference; Type: INDEX; Schema: manveru; Owner: -
 --
@@ -128,6 +406,34 @@ CREATE INDEX index_reference ON manveru.refs USING btree (reference);
 CREATE INDEX index_referrer ON manveru.refs USING btree (referrer);
 
 
+--
+-- Name: index_staged_nars_nar_hash; Type: INDEX; Schema: manveru; Owner: -
+--
+
+CREATE INDEX index_staged_nars_nar_hash ON manveru.staged_nars USING btree (nar_hash);
+
+
+--
+-- Name: index_temp_roots_path; Type: INDEX; Schema: manveru; Owner: -
+--
+
+CREATE INDEX index_temp_roots_path ON manveru.temp_roots USING btree (path);
+
+
+--
+-- Name: index_valid_paths_file_hash; Type: INDEX; Schema: manveru; Owner: -
+--
+
+CREATE INDEX index_valid_paths_file_hash ON manveru.valid_paths USING btree (file_hash);
+
+
+--
+-- Name: index_valid_paths_hash_part; Type: INDEX; Schema: manveru; Owner: -
+--
+
+CREATE INDEX index_valid_paths_hash_part ON manveru.valid_paths USING btree (hash_part);
+
+
 --
 -- Name: derivation_outputs derivation_outputs_drv_fkey; Type: FK CONSTRAINT; Schema: manveru; Owner: -
 --
@@ -136,6 +442,22 @@ ALTER TABLE ONLY manveru.derivation_outputs
     ADD CONSTRAINT derivation_outputs_drv_fkey FOREIGN KEY (drv) REFERENCES manveru.valid_paths(id) ON DELETE CASCADE;
 
 
+--
+-- Name: gc_roots gc_roots_path_fkey; Type: FK CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.gc_roots
+    ADD CONSTRAINT gc_roots_path_fkey FOREIGN KEY (path) REFERENCES manveru.valid_paths(id) ON DELETE RESTRICT;
+
+
+--
+-- Name: nar_chunks nar_chunks_chunk_fkey; Type: FK CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.nar_chunks
+    ADD CONSTRAINT nar_chunks_chunk_fkey FOREIGN KEY (chunk) REFERENCES manveru.chunks(hash) ON DELETE RESTRICT;
+
+
 --
 -- Name: refs refs_reference_fkey; Type: FK CONSTRAINT; Schema: manveru; Owner: -
 --
@@ -152,6 +474,14 @@ ALTER TABLE ONLY manveru.refs
     ADD CONSTRAINT refs_referrer_fkey FOREIGN KEY (referrer) REFERENCES manveru.valid_paths(id) ON DELETE CASCADE;
 
 
+--
+-- Name: temp_roots temp_roots_session_fkey; Type: FK CONSTRAINT; Schema: manveru; Owner: -
+--
+
+ALTER TABLE ONLY manveru.temp_roots
+    ADD CONSTRAINT temp_roots_session_fkey FOREIGN KEY (session) REFERENCES manveru.sessions(id) ON DELETE CASCADE;
+
+
 --
 -- PostgreSQL database dump complete
 --
@@ -162,4 +492,14 @@ ALTER TABLE ONLY manveru.refs
 --
 
 INSERT INTO manveru.schema_migrations (version) VALUES
-    ('20221120032825');
+    ('20221120032825'),
+    ('20221122093512'),
+    ('20221123141207'),
+    ('20221125102344'),
+    ('20221128163051'),
+    ('20221130110254'),
+    ('20221201143817'),
+    ('20221202094129'),
+    ('20221205101532'),
+    ('20221207091544'),
+    ('20221207152203');
@@ -0,0 +1,243 @@
+package protocol
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	nixhash "github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/nixpath"
+	"github.com/pkg/errors"
+)
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// contentAddressMethod is how the content of AddToStore is addressed, as in
+// text:sha256, fixed:r:sha256 or fixed:<algorithm>.
+type contentAddressMethod struct {
+	text      bool
+	recursive bool
+	algorithm string
+}
+
+func parseContentAddressMethod(s string) (*contentAddressMethod, error) {
+	method := &contentAddressMethod{}
+	if s == "text:sha256" {
+		method.text, method.algorithm = true, "sha256"
+	} else if strings.HasPrefix(s, "fixed:") {
+		rest := strings.TrimPrefix(s, "fixed:")
+		method.recursive = strings.HasPrefix(rest, "r:")
+		method.algorithm = strings.TrimPrefix(rest, "r:")
+	} else {
+		return nil, errors.Errorf("unsupported content address method: %s", s)
+	}
+
+	if _, ok := hashAlgorithms[method.algorithm]; !ok {
+		return nil, errors.Errorf("unsupported hash algorithm: %s", method.algorithm)
+	}
+	return method, nil
+}
+
+// hasReferences is whether paths added this way can refer to other paths.
+func (m *contentAddressMethod) hasReferences() bool {
+	return m.text || (m.recursive && m.algorithm == "sha256")
+}
+
+// canHaveReferences is whether a path with the content address ca can refer
+// to other paths. Fixed-output paths other than fixed:r:sha256 cannot, so
+// store paths in their contents are just text.
+func canHaveReferences(ca string) bool {
+	return ca == "" || strings.HasPrefix(ca, "text:") || strings.HasPrefix(ca, "fixed:r:sha256:")
+}
+
+// contentAddress returns the ca field of a path with the given digest.
+func (m *contentAddressMethod) contentAddress(digest []byte) string {
+	if m.text {
+		return "text:sha256:" + nixbase32.EncodeToString(digest)
+	} else if m.recursive {
+		return "fixed:r:" + m.algorithm + ":" + nixbase32.EncodeToString(digest)
+	}
+	return "fixed:" + m.algorithm + ":" + nixbase32.EncodeToString(digest)
+}
+
+// storePath computes the path of content with the given digest and
+// references, like nix does in makeTextPath and makeFixedOutputPath.
+func (m *contentAddressMethod) storePath(name string, digest []byte, references []string) string {
+	if !m.hasReferences() {
+		prefix := ""
+		if m.recursive {
+			prefix = "r:"
+		}
+		inner := sha256.Sum256([]byte("fixed:out:" + prefix + m.algorithm + ":" + hex.EncodeToString(digest) + ":"))
+		return makeStorePath("output:out", inner[:], name)
+	}
+
+	kind := "source"
+	if m.text {
+		kind = "text"
+	}
+	for _, reference := range references {
+		kind += ":" + reference
+	}
+	return makeStorePath(kind, digest, name)
+}
+
+// makeStorePath returns the store path for a sha256 digest of the given kind.
+func makeStorePath(kind string, digest []byte, name string) string {
+	fingerprint := sha256.Sum256([]byte(kind + ":sha256:" + hex.EncodeToString(digest) + ":" + nixpath.StoreDir + ":" + name))
+	return nixpath.Absolute(nixbase32.EncodeToString(nixhash.CompressHash(fingerprint[:], nixpath.PathHashSize)) + "-" + name)
+}
+
+// addCAToStore implements AddToStore of protocol 1.25 and later. Instead of
+// trusting the references sent by the client, the content is scanned for
+// every valid path, and the store path is computed from those it contains.
+func (c *client) addCAToStore() {
+	name := c.readString(1024)
+	camStr := c.readString(1024)
+	claimed := c.readStrings()
+	repair := c.readBool()
+	c.debug("addToStore:", name, camStr, claimed, "repair:", repair)
+
+	if c.err != nil {
+		return
+	}
+
+	dump, err := os.CreateTemp("", "add-to-store-")
+	if err != nil {
+		c.err = errors.WithMessage(err, "while creating temporary file")
+		return
+	}
+	defer os.Remove(dump.Name())
+	defer dump.Close()
+
+	var info *validPathInfo
+	method, err := parseContentAddressMethod(camStr)
+	if err != nil {
+		c.err = err
+	} else if err := nixpath.Validate(nixpath.StoreDir + "/" + strings.Repeat("0", 32) + "-" + name); err != nil {
+		c.err = errors.WithMessagef(err, "invalid name '%s'", name)
+	} else {
+		info, c.err = c.addDump(c.ctx, name, method, claimed, dump)
+	}
+
+	c.writeStderrLast()
+	if c.err == nil {
+		c.writeString(info.OutPath)
+		c.writeValidPathInfo(info)
+	}
+}
+
+// addDump stores the content read from the client for AddToStore, which is
+// a NAR for recursive methods and the file itself otherwise.
+func (c *client) addDump(ctx context.Context, name string, method *contentAddressMethod, claimed []string, dump *os.File) (*validPathInfo, error) {
+	dumpHash := hashAlgorithms[method.algorithm]()
+	size, err := io.Copy(io.MultiWriter(dump, dumpHash), newFramedSource(c.stdin))
+	if err != nil {
+		return nil, errors.WithMessage(err, "while reading content")
+	}
+
+	if !method.hasReferences() && len(claimed) > 0 {
+		return nil, errors.New("only text and fixed:r:sha256 paths can have references")
+	}
+
+	scanner, err := newReferenceScanner(claimed)
+	if err != nil {
+		return nil, err
+	}
+
+	narHash := sha256.New()
+	narReader := dumpNar(dump, size, method.recursive)
+	narSize, err := io.Copy(io.MultiWriter(narHash, scanner), narReader)
+	narReader.Close()
+	if err != nil {
+		return nil, errors.WithMessage(err, "while hashing NAR")
+	}
+
+	info := &validPathInfo{
+		NarHash:          "sha256:" + nixbase32.EncodeToString(narHash.Sum(nil)),
+		NarSize:          uint64(narSize),
+		References:       []string{},
+		RegistrationTime: time.Now(),
+		Sigs:             []string{},
+		CA:               method.contentAddress(dumpHash.Sum(nil)),
+	}
+
+	// The references are every valid path the content mentions, claimed or
+	// not, so they can't be left out to get another path for it.
+	if method.hasReferences() {
+		found, undeclared, err := scanner.found(ctx, c.db, "", claimed)
+		if err != nil {
+			return nil, err
+		}
+		info.References = uniqueStrings(append(found, undeclared...))
+		sort.Strings(info.References)
+	}
+
+	info.OutPath = method.storePath(name, dumpHash.Sum(nil), info.References)
+
+	narReader = dumpNar(dump, size, method.recursive)
+	defer narReader.Close()
+	if err := c.addToStore(ctx, info, narReader); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// dumpNar returns the NAR of the size bytes in dump. Recursive dumps are a
+// NAR already, flat ones are the contents of a single regular file.
+func dumpNar(dump *os.File, size int64, recursive bool) io.ReadCloser {
+	if recursive {
+		return io.NopCloser(io.NewSectionReader(dump, 0, size))
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		nw, err := nar.NewWriter(w)
+		if err == nil {
+			err = nw.WriteHeader(&nar.Header{Path: "/", Type: nar.TypeRegular, Size: size})
+		}
+		if err == nil {
+			_, err = io.Copy(nw, io.NewSectionReader(dump, 0, size))
+		}
+		if err == nil {
+			err = nw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return r
+}
+
+// writeValidPathInfo writes info as the ValidPathInfo of the worker protocol,
+// without the path.
+func (c *client) writeValidPathInfo(info *validPathInfo) {
+	narHash, err := nixhash.ParseNixBase32(info.NarHash)
+	if err != nil {
+		c.err = errors.WithMessagef(err, "invalid NAR hash of %s", info.OutPath)
+		return
+	}
+
+	c.writeString(info.Deriver)
+	c.writeString(hex.EncodeToString(narHash.Digest()))
+	c.writeStrings(info.References)
+	c.writeInt(uint64(info.RegistrationTime.Unix()))
+	c.writeInt(info.NarSize)
+	c.writeBool(info.Ultimate)
+	c.writeStrings(info.Sigs)
+	c.writeString(info.CA)
+}
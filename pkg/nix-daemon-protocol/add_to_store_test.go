@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// Derivations from the test data of go-nix, made by nix.
+const (
+	barDrvPath = "/nix/store/0hm2f1psjpcwg8fijsmr4wwxrx59s092-bar.drv"
+	barDrv     = `Derive([("out","/nix/store/4q0pg5zpfmznxscq3avycvf9xdvx50n3-bar","r:sha256","08813cbee9903c62be4c5027726a418a300da4500b2d369d3af9286f4815ceba")],[],[],":",":",[],[("builder",":"),("name","bar"),("out","/nix/store/4q0pg5zpfmznxscq3avycvf9xdvx50n3-bar"),("outputHash","08813cbee9903c62be4c5027726a418a300da4500b2d369d3af9286f4815ceba"),("outputHashAlgo","sha256"),("outputHashMode","recursive"),("system",":")])`
+	fooDrvPath = "/nix/store/4wvvbi4jwn0prsdxb7vs673qa5h9gr7x-foo.drv"
+	fooDrv     = `Derive([("out","/nix/store/5vyvcwah9l9kf07d52rcgdk70g2f4y13-foo","","")],[("/nix/store/0hm2f1psjpcwg8fijsmr4wwxrx59s092-bar.drv",["out"])],[],":",":",[],[("bar","/nix/store/4q0pg5zpfmznxscq3avycvf9xdvx50n3-bar"),("builder",":"),("name","foo"),("out","/nix/store/5vyvcwah9l9kf07d52rcgdk70g2f4y13-foo"),("system",":")])`
+)
+
+func TestContentAddressMethodStorePath(t *testing.T) {
+	barDigest, fooDigest := sha256.Sum256([]byte(barDrv)), sha256.Sum256([]byte(fooDrv))
+
+	tests := []struct {
+		method     string
+		name       string
+		digest     string
+		references []string
+		want       string
+	}{
+		{method: "text:sha256", name: "bar.drv", digest: hex.EncodeToString(barDigest[:]), want: barDrvPath},
+		{method: "text:sha256", name: "foo.drv", digest: hex.EncodeToString(fooDigest[:]), references: []string{barDrvPath}, want: fooDrvPath},
+		{method: "fixed:r:sha256", name: "bar", digest: "08813cbee9903c62be4c5027726a418a300da4500b2d369d3af9286f4815ceba", want: "/nix/store/4q0pg5zpfmznxscq3avycvf9xdvx50n3-bar"},
+		{method: "fixed:r:sha1", name: "bar", digest: "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", want: "/nix/store/mp57d33657rf34lzvlbpfa1gjfv5gmpg-bar"},
+		{method: "fixed:sha256", name: "bash44-023", digest: "4fec236f3fbd3d0c47b893fdfa9122142a474f6ef66c20ffb6c0f4864dd591b6", want: "/nix/store/x9cyj78gzd1wjf0xsiad1pa3ricbj566-bash44-023"},
+	}
+
+	for _, test := range tests {
+		method, err := parseContentAddressMethod(test.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := hex.DecodeString(test.digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := method.storePath(test.name, digest, test.references); got != test.want {
+			t.Errorf("%s %s: got %s, want %s", test.method, test.name, got, test.want)
+		}
+	}
+}
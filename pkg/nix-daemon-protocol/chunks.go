@@ -0,0 +1,370 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/input-output-hk/nix-daemon-server/pkg/storage"
+	"github.com/jackc/pgx/v4"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/pkg/errors"
+)
+
+// NARs are split into content-defined chunks using a gear hash, so insertions
+// and deletions only change the chunks around them and near-identical NARs
+// share most of their chunks.
+const (
+	chunkMin  = 16 << 10
+	chunkMax  = 256 << 10
+	chunkMask = uint64(1<<16-1) << 48 // 64 KiB on average
+)
+
+// gearTable is filled with splitmix64 from a fixed seed, chunk boundaries
+// must never change between versions.
+var gearTable = func() (table [256]uint64) {
+	x := uint64(0x6e69782d63646300)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+type chunker struct {
+	from *bufio.Reader
+	buf  []byte
+}
+
+func newChunker(from io.Reader) *chunker {
+	return &chunker{from: bufio.NewReaderSize(from, chunkMax), buf: make([]byte, 0, chunkMax)}
+}
+
+// next returns the next chunk, which is only valid until the following call.
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	fingerprint := uint64(0)
+
+	for {
+		b, err := c.from.ReadByte()
+		if err == io.EOF && len(c.buf) > 0 {
+			return c.buf, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		c.buf = append(c.buf, b)
+		fingerprint = fingerprint<<1 + gearTable[b]
+		if len(c.buf) >= chunkMax || (len(c.buf) >= chunkMin && fingerprint&chunkMask == 0) {
+			return c.buf, nil
+		}
+	}
+}
+
+func chunkHash(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return "sha256:" + nixbase32.EncodeToString(sum[:])
+}
+
+func chunkKey(hash string) string {
+	return "chunks/" + strings.TrimPrefix(hash, "sha256:")
+}
+
+// putChunk stores chunk unless a chunk with the same hash exists already. It
+// returns the number of bytes written.
+func (s narStore) putChunk(ctx context.Context, hash string, chunk []byte) (int64, error) {
+	if _, err := s.blobs.Stat(ctx, chunkKey(hash)); err == nil {
+		return 0, nil
+	} else if err != storage.ErrNotFound {
+		return 0, errors.WithMessage(err, "while checking for chunk")
+	}
+
+	if err := s.blobs.Put(ctx, chunkKey(hash), bytes.NewReader(chunk)); err != nil {
+		return 0, errors.WithMessage(err, "while storing chunk")
+	}
+
+	return int64(len(chunk)), nil
+}
+
+type narChunk struct {
+	hash   string
+	size   int
+	offset int64
+}
+
+// storeChunks splits the NAR with narHash into chunks and stores them. Chunks
+// in only are stored even if they seem to exist, and others aren't stored at
+// all, unless only is nil. It returns the chunks and how many bytes were
+// written.
+func (s narStore) storeChunks(ctx context.Context, narHash, compression string, narSize int64, only map[string]bool) ([]narChunk, int64, error) {
+	blob, err := s.open(ctx, narHash, compression)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer blob.Close()
+
+	chunker := newChunker(newNarHashReader(blob, narHash, uint64(narSize)))
+	list := []narChunk{}
+	written, offset := int64(0), int64(0)
+
+	for {
+		chunk, err := chunker.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, errors.WithMessage(err, "while chunking NAR")
+		}
+
+		hash := chunkHash(chunk)
+		if only == nil {
+			n, err := s.putChunk(ctx, hash, chunk)
+			if err != nil {
+				return nil, 0, err
+			}
+			written += n
+		} else if only[hash] {
+			if err := s.blobs.Put(ctx, chunkKey(hash), bytes.NewReader(chunk)); err != nil {
+				return nil, 0, errors.WithMessage(err, "while storing chunk")
+			}
+			written += int64(len(chunk))
+		}
+		list = append(list, narChunk{hash: hash, size: len(chunk), offset: offset})
+		offset += int64(len(chunk))
+	}
+
+	return list, written, nil
+}
+
+// optimise moves the NAR with narHash from a single blob into uncompressed
+// chunks. It returns how many bytes that saved, which is negative if the NAR
+// was compressed better than its chunks.
+func (s narStore) optimise(ctx context.Context, narHash, compression string) (int64, error) {
+	info, err := s.blobs.Stat(ctx, narKey(narHash, compression))
+	if err != nil {
+		return 0, err
+	}
+
+	var narSize int64
+	if err := s.db.QueryRow(ctx, `
+		SELECT COALESCE(MAX(nar_size), 0) FROM valid_paths WHERE hash = $1;
+	`, narHash).Scan(&narSize); err != nil {
+		return 0, errors.WithMessage(err, "while selecting NAR size")
+	}
+
+	list, written, err := s.storeChunks(ctx, narHash, compression, narSize, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	sizes := map[string]int{}
+	for _, chunk := range list {
+		sizes[chunk.hash] = chunk.size
+	}
+
+	if err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock_shared($1);`, gcLockID); err != nil {
+			return errors.WithMessage(err, "while waiting for gc")
+		} else if err := lockNar(ctx, tx, narHash, true); err != nil {
+			return err
+		}
+
+		// The chunks were stored without any lock, so deleteUnused may have
+		// deleted those shared with another NAR since. Their rows are locked
+		// in order, like deleteUnused does, which keeps them until this is
+		// committed, and the chunks that are gone by now are stored again.
+		missing := map[string]bool{}
+		for _, hash := range sortedKeys(sizes) {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO chunks (hash, size) VALUES ($1, $2)
+				ON CONFLICT (hash) DO UPDATE SET size = excluded.size;
+			`, hash, sizes[hash]); err != nil {
+				return errors.WithMessage(err, "while inserting chunk")
+			} else if _, err := s.blobs.Stat(ctx, chunkKey(hash)); err == storage.ErrNotFound {
+				missing[hash] = true
+			} else if err != nil {
+				return errors.WithMessage(err, "while checking for chunk")
+			}
+		}
+		if len(missing) > 0 {
+			_, rewritten, err := s.storeChunks(ctx, narHash, compression, narSize, missing)
+			if err != nil {
+				return err
+			}
+			written += rewritten
+		}
+
+		for i, chunk := range list {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO nar_chunks (nar_hash, seq, chunk, nar_offset) VALUES ($1, $2, $3, $4)
+				ON CONFLICT DO NOTHING;
+			`, narHash, i, chunk.hash, chunk.offset); err != nil {
+				return errors.WithMessage(err, "while inserting NAR chunk")
+			}
+		}
+		// Chunks are served as the plain NAR, so the file is the NAR itself.
+		if _, err := tx.Exec(ctx, `
+			UPDATE valid_paths SET file_hash = hash, file_size = nar_size, compression = 'none'
+			WHERE hash = $1 AND compression = $2;
+		`, narHash, compression); err != nil {
+			return errors.WithMessage(err, "while updating NAR file")
+		}
+
+		// An upload staging the same NAR with this compression will need
+		// the blob once it's registered.
+		var staged bool
+		if err := tx.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM staged_nars WHERE nar_hash = $1 AND compression = $2 AND created_at > $3);
+		`, narHash, compression, time.Now().Add(-staleStagingAge)).Scan(&staged); err != nil {
+			return errors.WithMessage(err, "while checking NAR usage")
+		} else if staged {
+			return nil
+		}
+
+		// Deleted under the lock of the NAR, like in deleteUnused. Readers
+		// that looked up the old file fall back to the chunks.
+		if err := s.blobs.Delete(ctx, narKey(narHash, compression)); err != nil {
+			return errors.WithMessage(err, "while deleting optimised NAR")
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return info.Size - written, nil
+}
+
+// chunkedReader reassembles a NAR from its chunks, fetching one at a time.
+type chunkedReader struct {
+	ctx     context.Context
+	store   narStore
+	chunks  []string
+	skip    int64
+	current io.ReadCloser
+}
+
+func (s narStore) openChunked(ctx context.Context, narHash string) (*chunkedReader, error) {
+	return s.openChunkedAt(ctx, narHash, 0)
+}
+
+// openChunkedAt starts reading at offset, without fetching the chunks before
+// it.
+func (s narStore) openChunkedAt(ctx context.Context, narHash string, offset int64) (*chunkedReader, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT nar_chunks.chunk, nar_chunks.nar_offset
+		FROM nar_chunks JOIN chunks ON chunks.hash = nar_chunks.chunk
+		WHERE nar_chunks.nar_hash = $1 AND nar_chunks.nar_offset + chunks.size > $2
+		ORDER BY nar_chunks.seq;
+	`, narHash, offset)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while selecting NAR chunks")
+	}
+	defer rows.Close()
+
+	r := &chunkedReader{ctx: ctx, store: s}
+	for rows.Next() {
+		var chunk string
+		var chunkOffset int64
+		if err := rows.Scan(&chunk, &chunkOffset); err != nil {
+			return nil, errors.WithMessage(err, "while scanning NAR chunks")
+		}
+		if len(r.chunks) == 0 {
+			r.skip = offset - chunkOffset
+		}
+		r.chunks = append(r.chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "while selecting NAR chunks")
+	}
+
+	if len(r.chunks) == 0 {
+		return nil, storage.ErrNotFound
+	}
+
+	return r, nil
+}
+
+func (r *chunkedReader) Read(buf []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			blob, err := r.store.blobs.Get(r.ctx, chunkKey(r.chunks[0]), r.skip, -1)
+			if err != nil {
+				return 0, errors.WithMessage(err, "while opening chunk")
+			}
+			r.current = blob
+			r.chunks = r.chunks[1:]
+			r.skip = 0
+		}
+
+		n, err := r.current.Read(buf)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkedReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// optimiseNars moves all NARs still stored as a single file into chunks.
+func (c *client) optimiseNars(ctx context.Context) error {
+	rows, err := c.db.Query(ctx, `
+		SELECT DISTINCT hash, compression FROM valid_paths
+		WHERE NOT EXISTS (SELECT 1 FROM nar_chunks WHERE nar_chunks.nar_hash = valid_paths.hash);
+	`)
+	if err != nil {
+		return errors.WithMessage(err, "while selecting unoptimised NARs")
+	}
+
+	type nar struct{ hash, compression string }
+	nars := []nar{}
+	for rows.Next() {
+		var n nar
+		if err := rows.Scan(&n.hash, &n.compression); err != nil {
+			rows.Close()
+			return errors.WithMessage(err, "while scanning unoptimised NARs")
+		}
+		nars = append(nars, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.WithMessage(err, "while selecting unoptimised NARs")
+	}
+
+	saved, optimised := int64(0), 0
+	for _, n := range nars {
+		saving, err := c.nars.optimise(ctx, n.hash, n.compression)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			c.writeStderrNext("cannot optimise NAR " + n.hash + ": " + err.Error())
+			continue
+		}
+		saved += saving
+		optimised++
+	}
+
+	c.writeStderrNext(fmt.Sprintf("%.2f MiB freed by deduplicating %d NARs", float64(saved)/(1<<20), optimised))
+	return nil
+}
@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestChunker(t *testing.T) {
+	random := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		sizes []int
+	}{
+		{name: "empty", data: []byte{}, sizes: []int{}},
+		{name: "smaller than the minimum", data: random[:chunkMin-1], sizes: []int{chunkMin - 1}},
+		{name: "zeros are cut at the maximum", data: make([]byte, 2*chunkMax+1), sizes: []int{chunkMax, chunkMax, 1}},
+		// Boundaries must never move, or chunks stored by earlier versions
+		// aren't shared with new ones.
+		{name: "random", data: random, sizes: []int{
+			52966, 145911, 30260, 33663, 40714, 41505, 95688, 50793, 57823, 38519,
+			141174, 95250, 43370, 18284, 19288, 28195, 39030, 25680, 17424, 33039,
+		}},
+	}
+
+	for _, test := range tests {
+		c := newChunker(bytes.NewReader(test.data))
+		joined, sizes := []byte{}, []int{}
+		for {
+			chunk, err := c.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			joined = append(joined, chunk...)
+			sizes = append(sizes, len(chunk))
+		}
+
+		if !bytes.Equal(joined, test.data) {
+			t.Errorf("%s: chunks don't add up to the input", test.name)
+		} else if len(sizes) != len(test.sizes) {
+			t.Errorf("%s: got chunks of %v bytes, want %v", test.name, sizes, test.sizes)
+		} else {
+			for i := range sizes {
+				if sizes[i] != test.sizes[i] {
+					t.Errorf("%s: got chunks of %v bytes, want %v", test.name, sizes, test.sizes)
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"compress/bzip2"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// compressionExtension is the file extension nix binary caches use for NARs
+// compressed with compression.
+func compressionExtension(compression string) (string, error) {
+	switch compression {
+	case "", "none":
+		return "", nil
+	case "bzip2":
+		return ".bz2", nil
+	case "xz":
+		return ".xz", nil
+	case "zstd":
+		return ".zst", nil
+	default:
+		return "", errors.Errorf("unsupported compression: %s", compression)
+	}
+}
+
+// extensionCompression is the inverse of compressionExtension.
+func extensionCompression(ext string) (string, bool) {
+	for _, compression := range []string{"none", "bzip2", "xz", "zstd"} {
+		if e, _ := compressionExtension(compression); e == ext {
+			return compression, true
+		}
+	}
+	return "", false
+}
+
+// compress wraps w so everything written is compressed with compression. The
+// result must be closed to flush it, which doesn't close w.
+func compress(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	case "xz":
+		xw, err := xz.NewWriter(w)
+		return xw, errors.WithMessage(err, "while writing xz header")
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
+		return zw, errors.WithMessage(err, "while creating zstd writer")
+	default:
+		return nil, errors.Errorf("unsupported compression at rest: %s", compression)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// decompress wraps r according to the Compression field of a narinfo.
+func decompress(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "", "none":
+		return io.NopCloser(r), nil
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case "xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, errors.WithMessage(err, "while reading xz header")
+		}
+		return io.NopCloser(xr), nil
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.WithMessage(err, "while reading zstd header")
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, errors.Errorf("unsupported compression: %s", compression)
+	}
+}
@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// gcLockID is the Postgres advisory lock held exclusively while collecting
+// garbage and shared by anything that must not overlap with a collection.
+const gcLockID = 0x6e69782d6763 // nix-gc
+
+type gcAction uint64
+
+const (
+	gcReturnLive     gcAction = 0
+	gcReturnDead     gcAction = 1
+	gcDeleteDead     gcAction = 2
+	gcDeleteSpecific gcAction = 3
+)
+
+type gcOptions struct {
+	action        gcAction
+	pathsToDelete []string
+	maxFreed      uint64
+}
+
+type gcResults struct {
+	paths      []string
+	bytesFreed uint64
+	// narHashes of deleted paths, so their NARs can be deleted after commit.
+	narHashes []string
+}
+
+// liveGCPaths selects the ids of all paths reachable from permanent roots or
+// from temporary roots of live sessions.
+const liveGCPaths = `
+	WITH RECURSIVE roots(id) AS (
+		SELECT path FROM gc_roots
+		UNION
+		SELECT valid_paths.id FROM temp_roots
+		JOIN valid_paths ON valid_paths.path = temp_roots.path
+		WHERE temp_roots.session IN (` + liveSessions + `)
+	), live(id) AS (
+		SELECT id FROM roots
+		UNION
+		SELECT refs.reference FROM refs JOIN live ON refs.referrer = live.id
+	)
+	SELECT id FROM live
+`
+
+// collectGarbage runs a collection while holding the gc lock exclusively.
+// Deletions happen referrers first, so the RESTRICT on refs.reference never
+// trips and maxFreed may stop it at any point without leaving dangling
+// references.
+func collectGarbage(ctx context.Context, db *pgxpool.Pool, options gcOptions) (*gcResults, error) {
+	results := &gcResults{paths: []string{}}
+
+	err := db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1);`, gcLockID); err != nil {
+			return errors.WithMessage(err, "while acquiring gc lock")
+		} else if _, err := tx.Exec(ctx, `DELETE FROM sessions WHERE id NOT IN (`+liveSessions+`);`); err != nil {
+			return errors.WithMessage(err, "while deleting stale sessions")
+		} else if _, err := tx.Exec(ctx, `DELETE FROM staged_nars WHERE created_at < $1;`, time.Now().Add(-staleStagingAge)); err != nil {
+			return errors.WithMessage(err, "while deleting stale staged NARs")
+		} else if _, err := tx.Exec(ctx, `CREATE TEMPORARY TABLE gc_live ON COMMIT DROP AS `+liveGCPaths+`;`); err != nil {
+			return errors.WithMessage(err, "while finding live paths")
+		}
+
+		switch options.action {
+		case gcReturnLive:
+			return selectPaths(ctx, tx, &results.paths, `
+				SELECT path FROM valid_paths WHERE id IN (SELECT id FROM gc_live) ORDER BY path;
+			`)
+		case gcReturnDead:
+			return selectPaths(ctx, tx, &results.paths, `
+				SELECT path FROM valid_paths WHERE id NOT IN (SELECT id FROM gc_live) ORDER BY path;
+			`)
+		case gcDeleteDead:
+			if _, err := tx.Exec(ctx, `
+				CREATE TEMPORARY TABLE gc_dead ON COMMIT DROP AS
+				SELECT id FROM valid_paths WHERE id NOT IN (SELECT id FROM gc_live);
+			`); err != nil {
+				return errors.WithMessage(err, "while finding dead paths")
+			}
+		case gcDeleteSpecific:
+			// Like nix, deleting a path also deletes everything referring to it.
+			if _, err := tx.Exec(ctx, `
+				CREATE TEMPORARY TABLE gc_dead ON COMMIT DROP AS
+				WITH RECURSIVE referrers(id) AS (
+					SELECT id FROM valid_paths WHERE path = ANY($1)
+					UNION
+					SELECT refs.referrer FROM refs JOIN referrers ON refs.reference = referrers.id
+				)
+				SELECT id FROM referrers;
+			`, options.pathsToDelete); err != nil {
+				return errors.WithMessage(err, "while finding referrers")
+			}
+
+			var alive string
+			if err := tx.QueryRow(ctx, `
+				SELECT path FROM valid_paths WHERE id IN (SELECT id FROM gc_dead INTERSECT SELECT id FROM gc_live) LIMIT 1;
+			`).Scan(&alive); err == nil {
+				return errors.Errorf("cannot delete path '%s' since it is still alive", alive)
+			} else if err != pgx.ErrNoRows {
+				return errors.WithMessage(err, "while checking liveness")
+			}
+		default:
+			return errors.Errorf("unknown gc action: %d", options.action)
+		}
+
+		return deleteDeadPaths(ctx, tx, options.maxFreed, results)
+	})
+
+	return results, err
+}
+
+// deleteDeadPaths deletes the paths in gc_dead in rounds, each time only those
+// no other remaining path refers to.
+func deleteDeadPaths(ctx context.Context, tx pgx.Tx, maxFreed uint64, results *gcResults) error {
+	for {
+		rows, err := tx.Query(ctx, `
+			SELECT valid_paths.id, valid_paths.path, valid_paths.hash, COALESCE(valid_paths.nar_size, 0)
+			FROM valid_paths JOIN gc_dead ON gc_dead.id = valid_paths.id
+			WHERE NOT EXISTS (
+				SELECT 1 FROM refs
+				WHERE refs.reference = valid_paths.id AND refs.referrer <> valid_paths.id
+			);
+		`)
+		if err != nil {
+			return errors.WithMessage(err, "while selecting dead leaves")
+		}
+
+		ids := []int64{}
+		for rows.Next() && results.bytesFreed < maxFreed {
+			var id, size int64
+			var path, narHash string
+			if err := rows.Scan(&id, &path, &narHash, &size); err != nil {
+				rows.Close()
+				return errors.WithMessage(err, "while scanning dead leaves")
+			}
+			ids = append(ids, id)
+			results.paths = append(results.paths, path)
+			results.narHashes = append(results.narHashes, narHash)
+			results.bytesFreed += uint64(size)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return errors.WithMessage(err, "while selecting dead leaves")
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		if _, err := tx.Exec(ctx, `DELETE FROM refs WHERE referrer = ANY($1);`, ids); err != nil {
+			return errors.WithMessage(err, "while deleting references")
+		} else if _, err := tx.Exec(ctx, `DELETE FROM valid_paths WHERE id = ANY($1);`, ids); err != nil {
+			return errors.WithMessage(err, "while deleting paths")
+		} else if _, err := tx.Exec(ctx, `DELETE FROM gc_dead WHERE id = ANY($1);`, ids); err != nil {
+			return errors.WithMessage(err, "while deleting paths")
+		}
+
+		if results.bytesFreed >= maxFreed {
+			return nil
+		}
+	}
+}
+
+func selectPaths(ctx context.Context, tx pgx.Tx, dst *[]string, query string, args ...any) error {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return errors.WithMessage(err, "while selecting paths")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return errors.WithMessage(err, "while scanning paths")
+		}
+		*dst = append(*dst, path)
+	}
+
+	return errors.WithMessage(rows.Err(), "while selecting paths")
+}
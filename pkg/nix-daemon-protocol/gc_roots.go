@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// gcRoot is a named permanent root owned by a Github user. It keeps the
+// closure of Path alive until it's deleted again.
+type gcRoot struct {
+	GithubUser string    `db:"github_user"`
+	Name       string    `db:"name"`
+	Path       string    `db:"path"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// Link is how the root is presented to clients in FindRoots, similar to the
+// symlink in gcroots/ a local nix-daemon would report.
+func (r gcRoot) Link() string {
+	return r.GithubUser + "/" + r.Name
+}
+
+// addPermRoot creates or replaces the root called name for user, pointing it
+// at storePath, which must already be valid.
+func addPermRoot(ctx context.Context, db *pgxpool.Pool, user, name, storePath string) error {
+	if user == "" {
+		return errors.New("permanent roots require a user")
+	} else if name == "" {
+		return errors.New("permanent roots require a name")
+	}
+
+	tag, err := db.Exec(ctx, `
+		INSERT INTO gc_roots (github_user, name, path)
+		SELECT $1, $2, id FROM valid_paths WHERE path = $3
+		ON CONFLICT (github_user, name) DO UPDATE SET path = EXCLUDED.path, created_at = now();
+	`, user, name, storePath)
+	if err != nil {
+		return errors.WithMessage(err, "while inserting gc root")
+	} else if tag.RowsAffected() == 0 {
+		return errors.Errorf("path '%s' is not valid", storePath)
+	}
+
+	return nil
+}
+
+// rootOwner is whose roots identity may list: its own, or everyone's, given as
+// "", if it's trusted.
+func rootOwner(identity Identity) string {
+	if identity.Trusted {
+		return ""
+	}
+	return identity.User()
+}
+
+// findRoots returns the permanent roots of owner, or of all users if owner is
+// empty.
+func findRoots(ctx context.Context, db *pgxpool.Pool, owner string) ([]gcRoot, error) {
+	roots := []gcRoot{}
+	if err := pgxscan.Select(ctx, db, &roots, `
+		SELECT gc_roots.github_user, gc_roots.name, valid_paths.path, gc_roots.created_at
+		FROM gc_roots JOIN valid_paths ON valid_paths.id = gc_roots.path
+		WHERE $1 = '' OR gc_roots.github_user = $1
+		ORDER BY gc_roots.github_user, gc_roots.name;
+	`, owner); err != nil {
+		return nil, errors.WithMessage(err, "while selecting gc roots")
+	}
+
+	return roots, nil
+}
+
+// deletePermRoot removes the root called name from user. The paths it kept
+// alive become garbage unless something else refers to them.
+func deletePermRoot(ctx context.Context, db *pgxpool.Pool, user, name string) error {
+	tag, err := db.Exec(ctx, `DELETE FROM gc_roots WHERE github_user = $1 AND name = $2;`, user, name)
+	if err != nil {
+		return errors.WithMessage(err, "while deleting gc root")
+	} else if tag.RowsAffected() == 0 {
+		return errors.Errorf("no gc root named '%s'", name)
+	}
+
+	return nil
+}
+
+// gcRootsCommand implements `gc-roots list|add|delete` for sessions that ask
+// for it instead of `nix-daemon --stdio`, so CI can pin release closures with
+// a plain `ssh`.
+func gcRootsCommand(ctx context.Context, db *pgxpool.Pool, identity Identity, args []string, out io.Writer) error {
+	user := identity.User()
+	usage := errors.New("usage: gc-roots list | add <name> <store path> | delete <name>")
+
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		roots, err := findRoots(ctx, db, rootOwner(identity))
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, root := range roots {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", root.Link(), root.Path, root.CreatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	case args[0] == "add" && len(args) == 3:
+		return addPermRoot(ctx, db, user, args[1], args[2])
+	case args[0] == "delete" && len(args) == 2:
+		return deletePermRoot(ctx, db, user, args[1])
+	default:
+		return usage
+	}
+}
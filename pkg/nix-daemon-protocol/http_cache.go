@@ -0,0 +1,301 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixpath"
+	"github.com/pkg/errors"
+)
+
+const cacheInfo = "StoreDir: " + nixpath.StoreDir + "\nWantMassQuery: 1\nPriority: 40\n"
+
+var (
+	narInfoRoute = regexp.MustCompile(`^/([0-9a-df-np-sv-z]{32})\.narinfo$`)
+	listingRoute = regexp.MustCompile(`^/([0-9a-df-np-sv-z]{32})\.ls$`)
+	narRoute     = regexp.MustCompile(`^/nar/([0-9a-df-np-sv-z]{52})\.nar(\.[a-z0-9]+)?$`)
+	fileRoute    = regexp.MustCompile(`^/serve/([0-9a-df-np-sv-z]{32})(/.*)?$`)
+)
+
+// httpCache serves the store in the layout of a nix binary cache, so it can
+// be used as a substituter over plain HTTP, and accepts uploads from the
+// uploaders.
+type httpCache struct {
+	db          *pgxpool.Pool
+	nars        narStore
+	secretKey   *signature.SecretKey
+	trustedKeys []signature.PublicKey
+	uploaders   map[string]string
+	log         io.Writer
+}
+
+// HTTPCacheConfig is how ServeHTTPCache serves the store.
+type HTTPCacheConfig struct {
+	// ListenAddr is the address:port to listen on.
+	ListenAddr string
+	// SecretKeyFile holds a nix secret key to additionally sign narinfos
+	// with, if given.
+	SecretKeyFile string
+	// CredentialsFile has a login:token line for everyone allowed to upload.
+	CredentialsFile string
+	// TLSCertFile and TLSKeyFile make it serve HTTPS. Without them it serves
+	// plain HTTP, which has to be put behind a TLS terminator if it's
+	// reachable by others, as uploads send their credentials with every
+	// request.
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+// ServeHTTPCache serves the store as a binary cache as configured until that
+// fails. Uploads must be signed by one of the trusted public keys or be
+// content-addressed.
+func (s *Server) ServeHTTPCache(config HTTPCacheConfig) error {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return errors.New("TLS needs both a certificate and a key")
+	}
+
+	uploaders, err := readUploaders(config.CredentialsFile)
+	if err != nil {
+		return err
+	}
+
+	h := &httpCache{db: s.db, nars: s.nars, trustedKeys: s.trustedKeys, uploaders: uploaders, log: s.log}
+
+	if config.SecretKeyFile != "" {
+		content, err := os.ReadFile(config.SecretKeyFile)
+		if err != nil {
+			return errors.WithMessage(err, "while reading secret key")
+		}
+		secretKey, err := signature.LoadSecretKey(strings.TrimSpace(string(content)))
+		if err != nil {
+			return errors.WithMessage(err, "while parsing secret key")
+		}
+		h.secretKey = &secretKey
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := h.deleteStaleUploads(ctx); err != nil {
+					fmt.Fprintln(h.log, "deleting stale uploads failed:", err)
+				}
+			}
+		}
+	}()
+
+	if config.TLSCertFile != "" {
+		fmt.Fprintln(h.log, "serving binary cache over HTTPS on", config.ListenAddr)
+		return http.ListenAndServeTLS(config.ListenAddr, config.TLSCertFile, config.TLSKeyFile, h)
+	}
+
+	fmt.Fprintln(h.log, "serving binary cache on", config.ListenAddr)
+	return http.ListenAndServe(config.ListenAddr, h)
+}
+
+func (h *httpCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.Method == http.MethodPut {
+		err = h.serveUpload(w, r)
+	} else if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		err = &httpError{status: http.StatusMethodNotAllowed, message: "method not allowed"}
+	} else if r.URL.Path == "/nix-cache-info" {
+		w.Header().Set("Content-Type", "text/x-nix-cache-info")
+		_, err = io.WriteString(w, cacheInfo)
+	} else if match := narInfoRoute.FindStringSubmatch(r.URL.Path); match != nil {
+		err = h.serveNarInfo(r.Context(), w, match[1])
+	} else if match := listingRoute.FindStringSubmatch(r.URL.Path); match != nil {
+		err = h.serveListing(r.Context(), w, match[1])
+	} else if match := narRoute.FindStringSubmatch(r.URL.Path); match != nil {
+		err = h.serveNar(r.Context(), w, match[1], match[2], r.Method == http.MethodHead)
+	} else if match := fileRoute.FindStringSubmatch(r.URL.Path); match != nil {
+		err = h.serveFile(r, w, match[1], match[2])
+	} else {
+		err = errNotInCache
+	}
+
+	if err == errNotInCache || errors.Cause(err) == errNoSuchFile {
+		http.Error(w, "not found", http.StatusNotFound)
+	} else if httpErr, ok := err.(*httpError); ok {
+		http.Error(w, httpErr.message, httpErr.status)
+	} else if err != nil {
+		fmt.Fprintln(h.log, r.Method, r.URL.Path, "failed:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (h *httpCache) serveNarInfo(ctx context.Context, w http.ResponseWriter, hashPart string) error {
+	info, err := pathInfoByHashPart(ctx, h.db, hashPart)
+	if err != nil {
+		return err
+	}
+
+	ni, err := h.narInfo(info)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", ni.ContentType())
+	_, err = io.WriteString(w, ni.String())
+	return err
+}
+
+func (h *httpCache) serveListing(ctx context.Context, w http.ResponseWriter, hashPart string) error {
+	info, err := pathInfoByHashPart(ctx, h.db, hashPart)
+	if err != nil {
+		return err
+	}
+
+	listing, err := h.nars.listing(ctx, info.NarHash, info.Compression)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(listing)
+}
+
+// serveNar returns the NAR file with fileHash, or only its headers for head.
+func (h *httpCache) serveNar(ctx context.Context, w http.ResponseWriter, fileHash, ext string, head bool) error {
+	compression, ok := extensionCompression(ext)
+	if !ok {
+		return errNotInCache
+	}
+
+	var narHash string
+	var fileSize int64
+	if err := h.db.QueryRow(ctx, `
+		SELECT hash, file_size FROM valid_paths WHERE file_hash = $1 AND compression = $2 LIMIT 1;
+	`, "sha256:"+fileHash, compression).Scan(&narHash, &fileSize); err == pgx.ErrNoRows {
+		return errNotInCache
+	} else if err != nil {
+		return errors.WithMessage(err, "while selecting NAR file")
+	}
+
+	w.Header().Set("Content-Type", "application/x-nix-nar")
+	w.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
+	if head {
+		return nil
+	}
+
+	file, err := h.nars.openFile(ctx, narHash, compression)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// serveFile returns a single file from the NAR of the path with hashPart, or
+// the listing of a directory or symlink. Browsing isn't part of the binary
+// cache, so it needs the credentials of an uploader.
+func (h *httpCache) serveFile(r *http.Request, w http.ResponseWriter, hashPart, rel string) error {
+	if _, ok := h.uploader(r); !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nix-daemon-server"`)
+		return &httpError{status: http.StatusUnauthorized, message: "unauthorized"}
+	}
+
+	ctx := r.Context()
+	info, err := pathInfoByHashPart(ctx, h.db, hashPart)
+	if err != nil {
+		return err
+	}
+
+	node, contents, err := h.nars.openEntry(ctx, info.NarHash, info.Compression, rel)
+	if err != nil {
+		return err
+	} else if contents == nil {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(node)
+	}
+	defer contents.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(node.Size, 10))
+	_, err = io.Copy(w, contents)
+	return err
+}
+
+// narInfo describes info as a narinfo, signed by all signatures we have for
+// it and our own key.
+func (h *httpCache) narInfo(info *validPathInfo) (*narinfo.NarInfo, error) {
+	narHash, err := hash.ParseNixBase32(info.NarHash)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "invalid NAR hash of %s", info.OutPath)
+	}
+	fileHash, err := hash.ParseNixBase32(info.FileHash)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "invalid file hash of %s", info.OutPath)
+	}
+	ext, err := compressionExtension(info.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	ni := &narinfo.NarInfo{
+		StorePath:   info.OutPath,
+		URL:         "nar/" + strings.TrimPrefix(info.FileHash, "sha256:") + ".nar" + ext,
+		Compression: info.Compression,
+		FileHash:    fileHash,
+		FileSize:    info.FileSize,
+		NarHash:     narHash,
+		NarSize:     info.NarSize,
+		References:  make([]string, 0, len(info.References)),
+		CA:          info.CA,
+	}
+	if info.Deriver != "" {
+		ni.Deriver = path.Base(info.Deriver)
+	}
+	for _, reference := range info.References {
+		ni.References = append(ni.References, path.Base(reference))
+	}
+
+	signed := map[string]bool{}
+	for _, sig := range info.Sigs {
+		parsed, err := signature.ParseSignature(sig)
+		if err != nil {
+			continue
+		}
+		ni.Signatures = append(ni.Signatures, parsed)
+		signed[parsed.String()] = true
+	}
+
+	if h.secretKey != nil {
+		sig, err := h.secretKey.Sign(nil, ni.Fingerprint())
+		if err != nil {
+			return nil, errors.WithMessagef(err, "while signing %s", info.OutPath)
+		} else if !signed[sig.String()] {
+			ni.Signatures = append(ni.Signatures, sig)
+		}
+	}
+
+	return ni, nil
+}
+
+// pathInfoByHashPart returns the valid path whose name starts with hashPart,
+// with its references in order. It returns errNotInCache if there is none.
+func pathInfoByHashPart(ctx context.Context, db *pgxpool.Pool, hashPart string) (*validPathInfo, error) {
+	return selectPathInfo(ctx, db, `hash_part = $1`, hashPart)
+}
@@ -0,0 +1,271 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/input-output-hk/nix-daemon-server/pkg/storage"
+	"github.com/jackc/pgx/v4"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/nixpath"
+	"github.com/pkg/errors"
+)
+
+// staleUploadAge is how long an uploaded NAR may wait for its narinfo.
+const staleUploadAge = 24 * time.Hour
+
+// httpError is returned by handlers to answer with a status other than 500.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...any) error {
+	return &httpError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// readUploaders reads the credentials allowed to upload, one login:token per
+// line, as given to nix with a netrc file.
+func readUploaders(credentialsFile string) (map[string]string, error) {
+	uploaders := map[string]string{}
+	if credentialsFile == "" {
+		return uploaders, nil
+	}
+
+	fd, err := os.Open(credentialsFile)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while opening upload credentials")
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		login, token, ok := strings.Cut(line, ":")
+		if !ok || login == "" || token == "" {
+			return nil, errors.Errorf("invalid line in upload credentials: expected login:token")
+		}
+		uploaders[login] = token
+	}
+
+	return uploaders, errors.WithMessage(scanner.Err(), "while reading upload credentials")
+}
+
+// uploader returns the login the request was authenticated as, if any.
+func (h *httpCache) uploader(r *http.Request) (string, bool) {
+	login, token, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	expected, ok := h.uploaders[login]
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return "", false
+	}
+
+	return login, true
+}
+
+// serveUpload handles the PUTs of nix copy --to. NARs are kept aside until
+// their narinfo arrives, which is when the path becomes valid. Listings are
+// accepted but ignored, we make our own.
+func (h *httpCache) serveUpload(w http.ResponseWriter, r *http.Request) error {
+	login, ok := h.uploader(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nix-daemon-server"`)
+		return &httpError{status: http.StatusUnauthorized, message: "unauthorized"}
+	}
+
+	var err error
+	if match := narInfoRoute.FindStringSubmatch(r.URL.Path); match != nil {
+		err = h.putNarInfo(r.Context(), r.Body, login, match[1])
+	} else if match := narRoute.FindStringSubmatch(r.URL.Path); match != nil {
+		err = h.putNar(r.Context(), r, login, match[1], match[2])
+	} else if listingRoute.MatchString(r.URL.Path) {
+		_, err = io.Copy(io.Discard, r.Body)
+	} else {
+		return &httpError{status: http.StatusForbidden, message: "uploads to " + r.URL.Path + " are not supported"}
+	}
+
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		fmt.Fprintln(h.log, login, "uploaded", r.URL.Path)
+	}
+	return err
+}
+
+func uploadKey(fileHash, ext string) string {
+	return "uploads/" + fileHash + ".nar" + ext
+}
+
+// putNar keeps the uploaded file, once its hash was checked against the one
+// in its name.
+func (h *httpCache) putNar(ctx context.Context, r *http.Request, login, fileHash, ext string) error {
+	if _, ok := extensionCompression(ext); !ok {
+		return badRequest("unsupported compression: %s", ext)
+	} else if r.ContentLength < 0 {
+		return &httpError{status: http.StatusLengthRequired, message: "length required"}
+	}
+
+	// Registered first, so a failed upload still gets cleaned up.
+	key := uploadKey(fileHash, ext)
+	if _, err := h.db.Exec(ctx, `
+		INSERT INTO uploads (key, uploader) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET uploader = $2, created_at = now();
+	`, key, login); err != nil {
+		return errors.WithMessage(err, "while registering upload")
+	}
+
+	file := newNarHashReader(r.Body, "sha256:"+fileHash, uint64(r.ContentLength))
+	if err := h.nars.blobs.Put(ctx, key, file); err != nil {
+		return badRequest("invalid upload: %s", err)
+	}
+
+	return nil
+}
+
+// putNarInfo makes the path described by the narinfo in body valid, using
+// the NAR login uploaded before. The path is kept by a GC root of the
+// uploader, named after it.
+func (h *httpCache) putNarInfo(ctx context.Context, body io.Reader, login, hashPart string) error {
+	ni, err := narinfo.Parse(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return badRequest("invalid narinfo: %s", err)
+	} else if ni.NarHash == nil || ni.FileHash == nil {
+		return badRequest("narinfo lacks NarHash or FileHash")
+	}
+
+	np, err := nixpath.FromString(ni.StorePath)
+	if err != nil {
+		return badRequest("invalid narinfo: %s", err)
+	} else if nixbase32.EncodeToString(np.Digest) != hashPart {
+		return badRequest("narinfo for %s uploaded as %s.narinfo", ni.StorePath, hashPart)
+	}
+
+	for _, reference := range ni.References {
+		if _, err := nixpath.FromString(nixpath.Absolute(reference)); err != nil {
+			return badRequest("invalid reference: %s", err)
+		}
+	}
+
+	info := pathInfoFromNarInfo(ni)
+	if err := checkClosure(ctx, h.db, []*validPathInfo{info}); errors.Cause(err) == errIncompleteClosure {
+		return badRequest("%s", err)
+	} else if err != nil {
+		return err
+	}
+
+	// Uploaders aren't trusted users, so only signed or content-addressed
+	// paths are accepted from them.
+	if err := verifySignature(info, h.trustedKeys); err != nil {
+		return &httpError{status: http.StatusForbidden, message: err.Error()}
+	}
+
+	ext, err := compressionExtension(ni.Compression)
+	if err != nil {
+		return badRequest("%s", err)
+	}
+
+	// Only the NARs of the same uploader are used, so nobody can register
+	// a path for a NAR without having it.
+	key := uploadKey(nixbase32.EncodeToString(ni.FileHash.Digest()), ext)
+	var uploader string
+	if err := h.db.QueryRow(ctx, `SELECT uploader FROM uploads WHERE key = $1;`, key).Scan(&uploader); err == pgx.ErrNoRows || (err == nil && uploader != login) {
+		return badRequest("the NAR of %s wasn't uploaded", ni.StorePath)
+	} else if err != nil {
+		return errors.WithMessage(err, "while selecting upload")
+	}
+
+	blob, err := h.nars.blobs.Get(ctx, key, 0, -1)
+	if err == storage.ErrNotFound {
+		return badRequest("the NAR of %s wasn't uploaded", ni.StorePath)
+	} else if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	nar, err := decompress(blob, ni.Compression)
+	if err != nil {
+		return badRequest("%s", err)
+	}
+	defer nar.Close()
+
+	// Like in a session, the temporary root keeps the path from being
+	// collected before it has its permanent one.
+	identity := Identity{Uploader: login}
+	sess, err := startSession(ctx, h.db, identity)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := sess.end(context.Background()); err != nil {
+			fmt.Fprintln(h.log, "ending upload session failed:", err)
+		}
+	}()
+
+	warn := func(msg string) { fmt.Fprintln(h.log, "warning:", msg) }
+	if err := sess.addTempRoot(ctx, info.OutPath); err != nil {
+		return err
+	} else if err := h.nars.add(ctx, info, nar, warn); err != nil {
+		return badRequest("cannot add %s: %s", ni.StorePath, err)
+	} else if err := addPermRoot(ctx, h.db, identity.User(), path.Base(info.OutPath), info.OutPath); err != nil {
+		return err
+	}
+
+	return h.deleteUpload(ctx, key)
+}
+
+func (h *httpCache) deleteUpload(ctx context.Context, key string) error {
+	if err := h.nars.blobs.Delete(ctx, key); err != nil && err != storage.ErrNotFound {
+		return errors.WithMessage(err, "while deleting upload")
+	}
+
+	_, err := h.db.Exec(ctx, `DELETE FROM uploads WHERE key = $1;`, key)
+	return errors.WithMessage(err, "while deleting upload")
+}
+
+// deleteStaleUploads deletes NARs whose narinfo never arrived.
+func (h *httpCache) deleteStaleUploads(ctx context.Context) error {
+	rows, err := h.db.Query(ctx, `SELECT key FROM uploads WHERE created_at < $1;`, time.Now().Add(-staleUploadAge))
+	if err != nil {
+		return errors.WithMessage(err, "while selecting stale uploads")
+	}
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return errors.WithMessage(err, "while scanning stale uploads")
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.WithMessage(err, "while selecting stale uploads")
+	}
+
+	for _, key := range keys {
+		if err := h.deleteUpload(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
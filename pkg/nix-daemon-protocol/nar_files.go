@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/input-output-hk/nix-daemon-server/pkg/storage"
+	"github.com/jackc/pgx/v4"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nixpath"
+	"github.com/pkg/errors"
+)
+
+var errNoSuchFile = errors.New("no such file in NAR")
+
+// pathNar returns the hash and compression of the NAR of storePath.
+func (s narStore) pathNar(ctx context.Context, storePath string) (string, string, error) {
+	var narHash, compression string
+	if err := s.db.QueryRow(ctx, `
+		SELECT hash, compression FROM valid_paths WHERE path = $1;
+	`, storePath).Scan(&narHash, &compression); err == pgx.ErrNoRows {
+		return "", "", errors.Errorf("path '%s' is not valid", storePath)
+	} else if err != nil {
+		return "", "", errors.WithMessage(err, "while selecting NAR")
+	}
+	return narHash, compression, nil
+}
+
+// openRange returns length bytes of the uncompressed NAR with narHash, from
+// offset on. Uncompressed and optimised NARs are read with range requests,
+// compressed ones have to be decompressed from the start.
+func (s narStore) openRange(ctx context.Context, narHash, compression string, offset, length int64) (io.ReadCloser, error) {
+	if compression == "none" {
+		blob, err := s.blobs.Get(ctx, narKey(narHash, compression), offset, length)
+		if err != storage.ErrNotFound {
+			return blob, err
+		}
+
+		chunked, err := s.openChunkedAt(ctx, narHash, offset)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{Reader: io.LimitReader(chunked, length), close: chunked.Close}, nil
+	}
+
+	nar, err := s.open(ctx, narHash, compression)
+	if err != nil {
+		return nil, err
+	} else if _, err := io.CopyN(io.Discard, nar, offset); err != nil {
+		nar.Close()
+		return nil, errors.WithMessage(err, "while skipping to file")
+	}
+	return readCloser{Reader: io.LimitReader(nar, length), close: nar.Close}, nil
+}
+
+// openEntry looks up rel in the NAR with narHash. For regular files it also
+// returns their contents, without reading the rest of the NAR if possible.
+func (s narStore) openEntry(ctx context.Context, narHash, compression, rel string) (*listingNode, io.ReadCloser, error) {
+	list, err := s.listing(ctx, narHash, compression)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	node, err := list.lookup(rel)
+	if err != nil || node.Type != nar.TypeRegular {
+		return node, nil, err
+	}
+
+	contents, err := s.openRange(ctx, narHash, compression, node.NAROffset, node.Size)
+	return node, contents, err
+}
+
+// lookup returns the node at rel, relative to the root of the NAR. Symlinks
+// are not followed.
+func (l *listing) lookup(rel string) (*listingNode, error) {
+	node := l.Root
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" {
+			continue
+		} else if node.Type != nar.TypeDirectory {
+			return nil, errors.WithMessagef(errNoSuchFile, "'%s' is not a directory", rel)
+		} else if node = node.Entries[name]; node == nil {
+			return nil, errors.WithMessagef(errNoSuchFile, "'%s' does not exist", rel)
+		}
+	}
+	return node, nil
+}
+
+// splitStorePath splits a path below the store into the store path and the
+// path inside of it.
+func splitStorePath(p string) (string, string, error) {
+	rel := strings.TrimPrefix(p, nixpath.StoreDir+"/")
+	if rel == p {
+		return "", "", errors.Errorf("path '%s' is not in the Nix store", p)
+	}
+
+	name, rest, _ := strings.Cut(rel, "/")
+	storePath := nixpath.StoreDir + "/" + name
+	if _, err := nixpath.FromString(storePath); err != nil {
+		return "", "", err
+	}
+
+	return storePath, rest, nil
+}
+
+// filesCommand implements the ls and cat commands over SSH, which read from
+// stored NARs like nix store ls and nix store cat do from a local store.
+func filesCommand(ctx context.Context, nars narStore, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: ls|cat <path in store>")
+	}
+
+	storePath, rel, err := splitStorePath(args[1])
+	if err != nil {
+		return err
+	}
+
+	narHash, compression, err := nars.pathNar(ctx, storePath)
+	if err != nil {
+		return err
+	}
+
+	node, contents, err := nars.openEntry(ctx, narHash, compression, rel)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "cat":
+		if contents == nil {
+			return errors.Errorf("'%s' is not a regular file", args[1])
+		}
+		defer contents.Close()
+		_, err := io.Copy(out, contents)
+		return err
+	case "ls":
+		if contents != nil {
+			contents.Close()
+		}
+		if node.Type != nar.TypeDirectory {
+			return writeListingEntry(out, args[1], node)
+		}
+		names := make([]string, 0, len(node.Entries))
+		for name := range node.Entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := writeListingEntry(out, name, node.Entries[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// writeListingEntry writes node in the format of nix store ls --long.
+func writeListingEntry(out io.Writer, name string, node *listingNode) error {
+	var err error
+	switch node.Type {
+	case nar.TypeRegular:
+		mode := "-r--r--r--"
+		if node.Executable {
+			mode = "-r-xr-xr-x"
+		}
+		_, err = fmt.Fprintf(out, "%s %20d %s\n", mode, node.Size, name)
+	case nar.TypeDirectory:
+		_, err = fmt.Fprintf(out, "%s %20d %s\n", "dr-xr-xr-x", 0, name)
+	case nar.TypeSymlink:
+		_, err = fmt.Fprintf(out, "%s %20d %s -> %s\n", "lrwxrwxrwx", 0, name, node.Target)
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/pkg/errors"
+)
+
+// listing is the .ls file nix writes to binary caches with write-nar-listing.
+type listing struct {
+	Version int          `json:"version"`
+	Root    *listingNode `json:"root"`
+}
+
+type listingNode struct {
+	Type       nar.NodeType            `json:"type"`
+	Entries    map[string]*listingNode `json:"entries"`
+	Size       int64                   `json:"size"`
+	Executable bool                    `json:"executable"`
+	NAROffset  int64                   `json:"narOffset"`
+	Target     string                  `json:"target"`
+}
+
+// MarshalJSON only includes the fields nix writes for the type of n.
+func (n *listingNode) MarshalJSON() ([]byte, error) {
+	switch n.Type {
+	case nar.TypeDirectory:
+		return json.Marshal(struct {
+			Type    nar.NodeType            `json:"type"`
+			Entries map[string]*listingNode `json:"entries"`
+		}{n.Type, n.Entries})
+	case nar.TypeRegular:
+		return json.Marshal(struct {
+			Type       nar.NodeType `json:"type"`
+			Size       int64        `json:"size"`
+			Executable bool         `json:"executable,omitempty"`
+			NAROffset  int64        `json:"narOffset"`
+		}{n.Type, n.Size, n.Executable, n.NAROffset})
+	default:
+		return json.Marshal(struct {
+			Type   nar.NodeType `json:"type"`
+			Target string       `json:"target"`
+		}{n.Type, n.Target})
+	}
+}
+
+// narListing builds the listing of the NAR read from r. The narOffset of
+// regular files is where their contents start in the NAR.
+func narListing(r io.Reader) (*listing, error) {
+	counter := &countingReader{from: r}
+	nr, err := nar.NewReader(counter)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while reading NAR")
+	}
+	defer nr.Close()
+
+	root := &listing{Version: 1}
+	nodes := map[string]*listingNode{}
+
+	for {
+		header, err := nr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.WithMessage(err, "while reading NAR")
+		}
+
+		node := &listingNode{Type: header.Type}
+		switch header.Type {
+		case nar.TypeDirectory:
+			node.Entries = map[string]*listingNode{}
+		case nar.TypeRegular:
+			// The parser stops right after the size of the contents until
+			// the next call to Next, so this is where they start.
+			node.Size, node.Executable, node.NAROffset = header.Size, header.Executable, counter.n
+		case nar.TypeSymlink:
+			node.Target = header.LinkTarget
+		}
+
+		if header.Path == "/" {
+			root.Root = node
+			nodes["/"] = node
+			continue
+		}
+
+		parent, ok := nodes[path.Dir(header.Path)]
+		if !ok || parent.Type != nar.TypeDirectory {
+			return nil, errors.Errorf("NAR entry %s has no parent directory", header.Path)
+		}
+		parent.Entries[path.Base(header.Path)] = node
+		nodes[header.Path] = node
+	}
+
+	if root.Root == nil {
+		return nil, errors.New("NAR has no root entry")
+	}
+
+	return root, nil
+}
+
+type countingReader struct {
+	from io.Reader
+	n    int64
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.from.Read(buf)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+type narEntry struct {
+	header   nar.Header
+	contents string
+}
+
+func makeNar(t *testing.T, entries ...narEntry) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	nw, err := nar.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		header := entry.header
+		header.Size = int64(len(entry.contents))
+		if err := nw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		} else if _, err := nw.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNarListing(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []narEntry
+		want    string
+	}{
+		{
+			name:    "regular file",
+			entries: []narEntry{{header: nar.Header{Path: "/", Type: nar.TypeRegular}, contents: "hello"}},
+			want:    `{"version":1,"root":{"type":"regular","size":5,"narOffset":96}}`,
+		},
+		{
+			name: "directory",
+			entries: []narEntry{
+				{header: nar.Header{Path: "/", Type: nar.TypeDirectory}},
+				{header: nar.Header{Path: "/bin", Type: nar.TypeDirectory}},
+				{header: nar.Header{Path: "/bin/hello", Type: nar.TypeRegular, Executable: true}, contents: "#!/bin/sh\n"},
+				{header: nar.Header{Path: "/lib", Type: nar.TypeSymlink, LinkTarget: "bin"}},
+			},
+			want: `{"version":1,"root":{"type":"directory","entries":{` +
+				`"bin":{"type":"directory","entries":{"hello":{"type":"regular","size":10,"executable":true,"narOffset":400}}},` +
+				`"lib":{"type":"symlink","target":"bin"}}}}`,
+		},
+	}
+
+	for _, test := range tests {
+		ls, err := narListing(bytes.NewReader(makeNar(t, test.entries...)))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if got, err := json.Marshal(ls); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		} else if string(got) != test.want {
+			t.Errorf("%s: got  %s\nwant %s", test.name, got, test.want)
+		}
+	}
+}
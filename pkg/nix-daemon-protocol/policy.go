@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// operationGroups name the operations a policy usually grants together.
+var operationGroups = map[string][]WorkerOperation{
+	"read": {
+		WOPIsValidPath, WOPQueryValidPaths, WOPQueryPathInfo, WOPQueryPathFromHashPart,
+		WOPQueryReferrers, WOPQueryValidDerivers, WOPQueryDerivationOutputMap, WOPQueryRealisation,
+		WOPQuerySubstitutablePaths, WOPQuerySubstitutablePathInfos, WOPQueryMissing,
+		WOPNarFromPath, WOPEnsurePath, WOPAddTempRoot, WOPFindRoots, WOPSyncWithGC,
+	},
+	"upload": {
+		WOPAddToStore, WOPAddTextToStore, WOPAddToStoreNar, WOPAddMultipleToStore,
+		WOPRegisterDrvOutput, WOPAddSignatures, WOPAddIndirectRoot, WOPAddBuildLog,
+	},
+	"gc": {
+		WOPCollectGarbage, WOPVerifyStore, WOPOptimiseStore,
+	},
+	"build": {
+		WOPBuildPaths, WOPBuildDerivation, WOPBuildPathsWithResults,
+	},
+}
+
+// alwaysAllowed are needed by every client before it can do anything else.
+var alwaysAllowed = []WorkerOperation{WOPSetOptions}
+
+// restricted operations aren't in any group and aren't allowed without rules.
+// QueryAllValidPaths enumerates the whole shared store.
+var restricted = []WorkerOperation{WOPQueryAllValidPaths}
+
+// maintenance operations change the whole shared store, so without rules only
+// trusted identities may use them.
+var maintenance = operationGroups["gc"]
+
+// policy decides which operations an identity may use. Without rules,
+// everything but the restricted operations is allowed, and maintenance only
+// to trusted identities.
+type policy struct {
+	rules []policyRule
+}
+
+// policyRule grants operations to a subject, which is user:<login> for GitHub
+// users, key:<principal> for keys of the authorized keys file,
+// team:<organization>/<team>, role:<role> or * for everyone.
+type policyRule struct {
+	subject    string
+	operations map[WorkerOperation]bool
+}
+
+// readPolicy reads rules from policyFile, one per line: a subject followed by
+// operation names like QueryPathInfo, or the groups read, upload, gc, build
+// and * for all of them. A line can only grant, so an identity may use what
+// any of the lines matching it allow.
+func readPolicy(policyFile string) (*policy, error) {
+	p := &policy{}
+	if policyFile == "" {
+		return p, nil
+	}
+
+	fd, err := os.Open(policyFile)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while opening policy")
+	}
+	defer fd.Close()
+
+	operations := map[string]WorkerOperation{}
+	for op := WOPQuitObsolete; op <= WOPBuildPathsWithResults; op++ {
+		operations[op.String()] = op
+	}
+
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		rule := policyRule{subject: fields[0], operations: map[WorkerOperation]bool{}}
+		if kind, _, _ := strings.Cut(rule.subject, ":"); rule.subject != "*" && kind != "user" && kind != "key" && kind != "team" && kind != "role" {
+			return nil, errors.Errorf("policy line %d: subject must be user:<login>, key:<principal>, team:<org>/<team>, role:<role> or *", line)
+		}
+
+		for _, name := range fields[1:] {
+			if op, ok := operations[name]; ok {
+				rule.operations[op] = true
+			} else if group, ok := operationGroups[name]; ok {
+				for _, op := range group {
+					rule.operations[op] = true
+				}
+			} else if name == "*" {
+				for _, op := range operations {
+					rule.operations[op] = true
+				}
+			} else {
+				return nil, errors.Errorf("policy line %d: unknown operation '%s'", line, name)
+			}
+		}
+
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, errors.WithMessage(scanner.Err(), "while reading policy")
+}
+
+// allows is whether identity may use op.
+func (p *policy) allows(identity Identity, op WorkerOperation) bool {
+	if len(p.rules) == 0 {
+		for _, denied := range restricted {
+			if op == denied {
+				return false
+			}
+		}
+		for _, trustedOnly := range maintenance {
+			if op == trustedOnly {
+				return identity.Trusted
+			}
+		}
+		return true
+	}
+
+	for _, allowed := range alwaysAllowed {
+		if op == allowed {
+			return true
+		}
+	}
+
+	for _, rule := range p.rules {
+		if rule.operations[op] && rule.matches(identity) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r policyRule) matches(identity Identity) bool {
+	switch {
+	case r.subject == "*":
+		return true
+	case strings.HasPrefix(r.subject, "user:"):
+		return identity.GithubUser != "" && strings.TrimPrefix(r.subject, "user:") == identity.GithubUser
+	case strings.HasPrefix(r.subject, "key:"):
+		return identity.KeyUser != "" && strings.TrimPrefix(r.subject, "key:") == identity.KeyUser
+	case strings.HasPrefix(r.subject, "role:"):
+		return contains(identity.Roles, strings.TrimPrefix(r.subject, "role:"))
+	default:
+		return contains(identity.Teams, strings.TrimPrefix(r.subject, "team:"))
+	}
+}
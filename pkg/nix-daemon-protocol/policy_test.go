@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy")
+	if err := os.WriteFile(policyFile, []byte(`
+		# subject               operations
+		team:input-output-hk/devs read
+		user:admin              *
+		key:hydra               upload
+		user:auditor            QueryAllValidPaths QueryPathInfo
+		*                       IsValidPath
+	`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := readPolicy(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noRules, err := readPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := Identity{GithubUser: "alice", Teams: []string{"input-output-hk/devs"}}
+	stranger := Identity{GithubUser: "stranger"}
+
+	tests := []struct {
+		name     string
+		policy   *policy
+		identity Identity
+		op       WorkerOperation
+		want     bool
+	}{
+		{name: "no rules", policy: noRules, identity: stranger, op: WOPAddToStoreNar, want: true},
+		{name: "no rules, restricted", policy: noRules, identity: stranger, op: WOPQueryAllValidPaths},
+		{name: "no rules, maintenance", policy: noRules, identity: stranger, op: WOPCollectGarbage},
+		{name: "no rules, maintenance when trusted", policy: noRules, identity: Identity{GithubUser: "admin", Trusted: true}, op: WOPOptimiseStore, want: true},
+		{name: "restricted isn't read", policy: rules, identity: alice, op: WOPQueryAllValidPaths},
+		{name: "restricted by name", policy: rules, identity: Identity{GithubUser: "auditor"}, op: WOPQueryAllValidPaths, want: true},
+		{name: "restricted with all operations", policy: rules, identity: Identity{GithubUser: "admin"}, op: WOPQueryAllValidPaths, want: true},
+		{name: "team", policy: rules, identity: alice, op: WOPQueryPathInfo, want: true},
+		{name: "team, other group", policy: rules, identity: alice, op: WOPAddToStoreNar},
+		{name: "key", policy: rules, identity: Identity{KeyUser: "hydra"}, op: WOPAddToStoreNar, want: true},
+		{name: "key rules don't match logins", policy: rules, identity: Identity{GithubUser: "hydra"}, op: WOPAddToStoreNar},
+		{name: "user rules don't match keys", policy: rules, identity: Identity{KeyUser: "admin"}, op: WOPCollectGarbage},
+		{name: "all operations", policy: rules, identity: Identity{GithubUser: "admin"}, op: WOPCollectGarbage, want: true},
+		{name: "operation by name", policy: rules, identity: Identity{GithubUser: "auditor"}, op: WOPQueryPathInfo, want: true},
+		{name: "operation not named", policy: rules, identity: Identity{GithubUser: "auditor"}, op: WOPNarFromPath},
+		{name: "everyone", policy: rules, identity: stranger, op: WOPIsValidPath, want: true},
+		{name: "always allowed", policy: rules, identity: stranger, op: WOPSetOptions, want: true},
+		{name: "nothing matches", policy: rules, identity: stranger, op: WOPQueryPathInfo},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.allows(test.identity, test.op); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	for _, invalid := range []string{"group:devs read\n", "user:alice read Frobnicate\n", "user:alice read\nalice read\n"} {
+		if err := os.WriteFile(policyFile, []byte(invalid), 0o644); err != nil {
+			t.Fatal(err)
+		} else if _, err := readPolicy(policyFile); err == nil {
+			t.Errorf("policy %q was accepted", invalid)
+		}
+	}
+}
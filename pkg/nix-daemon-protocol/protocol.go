@@ -0,0 +1,234 @@
+// Package protocol implements the nix daemon worker protocol on top of a
+// Postgres database and a blob store, so that any number of servers can
+// share one store.
+package protocol
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/input-output-hk/nix-daemon-server/pkg/storage"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/pkg/errors"
+)
+
+// Config is what a Server needs to open the store.
+type Config struct {
+	// DatabaseURL is the Postgres database with the valid paths.
+	DatabaseURL string
+	// MaxConns limits the connections of the shared pool, if set. Every
+	// session holds one for its temporary roots while it lasts, and most
+	// operations need another one, so it should allow two per session.
+	MaxConns int32
+	// BlobStore is where NARs are kept, as a local path or URL. Defaults to
+	// the directory nars.
+	BlobStore string
+	// NarCompression is one of none (the default), zstd or xz.
+	NarCompression string
+	// ReferenceCheck is reject (the default) or warn, for NARs that mention
+	// valid paths they don't declare as references.
+	ReferenceCheck string
+	// Substituters are space separated binary cache URLs to fetch missing
+	// paths from.
+	Substituters string
+	// TrustedPublicKeys are space separated nix public keys, of which
+	// substituted and uploaded paths must be signed by one if any are set.
+	TrustedPublicKeys string
+	// PolicyFile lists which operations identities may use. Without one,
+	// everyone may use all of them but QueryAllValidPaths, and only trusted
+	// identities may collect garbage, verify or optimise the store.
+	PolicyFile string
+	// Log receives diagnostics. Defaults to stderr.
+	Log io.Writer
+}
+
+// Identity is who is on the other end of a session, as authenticated by the
+// SSH server. Operations use it for authorization, and it's recorded with the
+// session and logged with every operation.
+type Identity struct {
+	// GithubUser is the login the SSH key belongs to, if it came from GitHub.
+	GithubUser string
+	// KeyUser is the principal of a key from the authorized keys file
+	// instead. Its name is unrelated to GitHub logins.
+	KeyUser string
+	// Uploader is the login of an HTTP cache uploader instead.
+	Uploader string
+	// SSHUser is the user name given to SSH. It isn't authenticated.
+	SSHUser string
+	// KeyFingerprint is the SHA256 fingerprint of the SSH key.
+	KeyFingerprint string
+	// Teams are the organization/team slugs GithubUser was found in.
+	Teams []string
+	// Roles are given to the members of some teams by the SSH server.
+	Roles []string
+	// Trusted users may add unsigned paths and change restricted settings,
+	// like the trusted-users of nix-daemon.
+	Trusted bool
+}
+
+// User names the identity where GitHub logins, key principals and uploaders
+// share a namespace, like the owners of GC roots, by prefixing principals
+// with key: and uploaders with upload:.
+func (i Identity) User() string {
+	if i.GithubUser == "" && i.KeyUser != "" {
+		return "key:" + i.KeyUser
+	} else if i.GithubUser == "" && i.Uploader != "" {
+		return "upload:" + i.Uploader
+	}
+	return i.GithubUser
+}
+
+func (i Identity) String() string {
+	return i.User() + " (" + i.KeyFingerprint + ")"
+}
+
+// Server handles sessions on a store, sharing one database pool between all
+// of them.
+type Server struct {
+	db           *pgxpool.Pool
+	nars         narStore
+	substituters []*binaryCache
+	trustedKeys  []signature.PublicKey
+	policy       *policy
+	log          io.Writer
+}
+
+// Open connects to the database and blob store given in config.
+func Open(ctx context.Context, config Config) (*Server, error) {
+	if config.DatabaseURL == "" {
+		return nil, errors.New("no database URL set")
+	}
+
+	substituters, err := parseSubstituters(config.Substituters)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedKeys, err := parseTrustedPublicKeys(config.TrustedPublicKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.BlobStore == "" {
+		config.BlobStore = "nars"
+	}
+	blobs, err := storage.Open(config.BlobStore)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.NarCompression == "" {
+		config.NarCompression = "none"
+	} else if !contains(narCompressions, config.NarCompression) {
+		return nil, errors.Errorf("unsupported NAR compression: %s", config.NarCompression)
+	}
+
+	if config.ReferenceCheck != "" && config.ReferenceCheck != "reject" && config.ReferenceCheck != "warn" {
+		return nil, errors.Errorf("unsupported reference check: %s", config.ReferenceCheck)
+	}
+
+	policy, err := readPolicy(config.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Log == nil {
+		config.Log = os.Stderr
+	}
+
+	dbConfig, err := pgxpool.ParseConfig(config.DatabaseURL)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while parsing database URL")
+	}
+	if config.MaxConns > 0 {
+		dbConfig.MaxConns = config.MaxConns
+	}
+
+	db, err := pgxpool.ConnectConfig(ctx, dbConfig)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while connecting to the database")
+	}
+
+	return &Server{
+		db:           db,
+		nars:         narStore{blobs: blobs, db: db, compression: config.NarCompression, warnOnly: config.ReferenceCheck == "warn"},
+		substituters: substituters,
+		trustedKeys:  trustedKeys,
+		policy:       policy,
+		log:          config.Log,
+	}, nil
+}
+
+// Close closes the database pool once all sessions ended.
+func (s *Server) Close() {
+	s.db.Close()
+}
+
+// Serve speaks the worker protocol with the client on rw, like nix-daemon
+// --stdio does, until the client hangs up.
+func (s *Server) Serve(ctx context.Context, rw io.ReadWriter, session Identity) (err error) {
+	c := client{
+		ctx:          ctx,
+		stdin:        rw,
+		stdout:       rw,
+		stderr:       s.log,
+		db:           s.db,
+		identity:     session,
+		policy:       s.policy,
+		requireSigs:  true,
+		nars:         s.nars,
+		substituters: s.substituters,
+		trustedKeys:  s.trustedKeys,
+	}
+
+	if c.session, err = startSession(ctx, s.db, session); err != nil {
+		return err
+	}
+
+	defer func() {
+		// The context may be cancelled already if the client hung up.
+		if err := c.session.end(context.Background()); err != nil {
+			c.debug("ending session:", err.Error())
+		}
+	}()
+
+	if err := c.handshake(); err != nil {
+		return err
+	}
+	return c.handleOperations()
+}
+
+// Command runs one of the commands that can be given to SSH instead of a
+// worker protocol session: gc-roots, ls or cat.
+func (s *Server) Command(ctx context.Context, session Identity, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("no command given")
+	}
+
+	// The commands are allowed like the operations doing the same.
+	op := WorkerOperation(WOPNarFromPath)
+	if args[0] == "gc-roots" && len(args) > 1 && args[1] == "list" {
+		op = WOPFindRoots
+	} else if args[0] == "gc-roots" {
+		op = WOPAddIndirectRoot
+	}
+	if !s.policy.allows(session, op) {
+		return errors.Errorf("user '%s' is not allowed to use %s", session.User(), args[0])
+	}
+
+	switch args[0] {
+	case "gc-roots":
+		return gcRootsCommand(ctx, s.db, session, args[1:], out)
+	case "ls", "cat":
+		return filesCommand(ctx, s.nars, args, out)
+	default:
+		return errors.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// IsCommand is whether name is handled by Command.
+func IsCommand(name string) bool {
+	return name == "gc-roots" || name == "ls" || name == "cat"
+}
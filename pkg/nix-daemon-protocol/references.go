@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/nixpath"
+	"github.com/nix-community/go-nix/pkg/nixpath/references"
+	"github.com/pkg/errors"
+)
+
+var (
+	storeDirPrefix = []byte(nixpath.StoreDir + "/")
+	hashPartLength = nixbase32.EncodedLen(nixpath.PathHashSize)
+)
+
+// referenceScanner finds references in a NAR written to it. Claimed references
+// are searched for like nix searches for the inputs of a build. We don't know
+// the inputs, so store paths mentioned anywhere are collected as well, to find
+// references that weren't claimed.
+type referenceScanner struct {
+	claimed   *references.ReferenceScanner
+	mentioned map[string]bool
+	// tail of the last write, in case a store path spans two writes.
+	tail []byte
+}
+
+func newReferenceScanner(claimed []string) (*referenceScanner, error) {
+	scanner, err := references.NewReferenceScanner(claimed)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid reference")
+	}
+	return &referenceScanner{claimed: scanner, mentioned: map[string]bool{}}, nil
+}
+
+func (s *referenceScanner) Write(buf []byte) (int, error) {
+	s.claimed.Write(buf)
+
+	window := append(s.tail, buf...)
+	for i := 0; ; {
+		found := bytes.Index(window[i:], storeDirPrefix)
+		if found < 0 {
+			break
+		}
+		start := i + found + len(storeDirPrefix)
+		if start+hashPartLength > len(window) {
+			break
+		}
+		if hashPart := string(window[start : start+hashPartLength]); isHashPart(hashPart) {
+			s.mentioned[hashPart] = true
+		}
+		i = start
+	}
+
+	keep := len(storeDirPrefix) + hashPartLength - 1
+	if len(window) > keep {
+		window = window[len(window)-keep:]
+	}
+	s.tail = append(s.tail[:0], window...)
+
+	return len(buf), nil
+}
+
+func isHashPart(s string) bool {
+	return strings.Trim(s, nixbase32.Alphabet) == ""
+}
+
+// found returns the claimed references that occur in the NAR, and the valid
+// paths that occur without being claimed. storePath itself is never
+// undeclared.
+func (s *referenceScanner) found(ctx context.Context, db *pgxpool.Pool, storePath string, claimed []string) ([]string, []string, error) {
+	found := s.claimed.References()
+
+	isClaimed := map[string]bool{}
+	for _, reference := range append(claimed, storePath) {
+		if np, err := nixpath.FromString(reference); err == nil {
+			isClaimed[nixbase32.EncodeToString(np.Digest)] = true
+		}
+	}
+
+	hashParts := []string{}
+	for hashPart := range s.mentioned {
+		if !isClaimed[hashPart] {
+			hashParts = append(hashParts, hashPart)
+		}
+	}
+	if len(hashParts) == 0 {
+		return found, nil, nil
+	}
+
+	rows, err := db.Query(ctx, `SELECT path FROM valid_paths WHERE hash_part = ANY($1) ORDER BY path;`, hashParts)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "while selecting mentioned paths")
+	}
+	defer rows.Close()
+
+	undeclared := []string{}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, nil, errors.WithMessage(err, "while scanning mentioned paths")
+		}
+		undeclared = append(undeclared, path)
+	}
+
+	return found, undeclared, errors.WithMessage(rows.Err(), "while selecting mentioned paths")
+}
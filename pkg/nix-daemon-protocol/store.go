@@ -0,0 +1,761 @@
+package protocol
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/input-output-hk/nix-daemon-server/pkg/storage"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/pkg/errors"
+)
+
+// narStore keeps one blob per NAR, named after its hash and compressed with
+// the compression configured when it was added, until OptimiseStore splits it
+// into chunks shared with other NARs.
+type narStore struct {
+	blobs       storage.BlobStore
+	db          *pgxpool.Pool
+	compression string
+	// warnOnly downgrades undeclared references to warnings.
+	warnOnly bool
+}
+
+// narCompressions are the compressions NARs may be stored with, see
+// compressionExtension.
+var narCompressions = []string{"none", "xz", "zstd"}
+
+func narKey(narHash, compression string) string {
+	ext, _ := compressionExtension(compression)
+	return "nar/" + strings.TrimPrefix(narHash, "sha256:") + ".nar" + ext
+}
+
+// staleStagingAge is how long a staged NAR counts as used without its path
+// becoming valid, in case the upload never got to clean up.
+const staleStagingAge = 24 * time.Hour
+
+// narLockClass keys the advisory locks of single NARs, see lockNar.
+const narLockClass = 0x6e6172 // nar
+
+// lockNar takes the lock of the NAR with narHash until tx ends. It's held
+// exclusively while the blobs of the NAR are deleted, and shared while it's
+// marked as staged, so a NAR found to be unused can't be picked up by an
+// upload before its blobs are gone.
+func lockNar(ctx context.Context, tx pgx.Tx, narHash string, exclusive bool) error {
+	query := `SELECT pg_advisory_xact_lock_shared($1, hashtext($2));`
+	if exclusive {
+		query = `SELECT pg_advisory_xact_lock($1, hashtext($2));`
+	}
+	_, err := tx.Exec(ctx, query, narLockClass, narHash)
+	return errors.WithMessage(err, "while locking NAR")
+}
+
+// put compresses and stores the NAR read from r, and records the resulting
+// file in info. Its listing is built on the way. The blob only appears once r
+// was read without error, and is deleted again if it isn't a valid NAR.
+//
+// The NAR counts as staged from then on, so it isn't deleted as unused, until
+// it's registered or unstaged.
+func (s narStore) put(ctx context.Context, info *validPathInfo, r io.Reader) error {
+	if err := s.markStaged(ctx, info); err != nil {
+		return err
+	}
+
+	file := &fileHashWriter{hash: sha256.New()}
+	pr, pw := io.Pipe()
+	lr, lw := io.Pipe()
+
+	var list *listing
+	listed := make(chan error, 1)
+	go func() {
+		var err error
+		list, err = narListing(lr)
+		// Keep the tee going even if the NAR turned out to be garbage.
+		io.Copy(io.Discard, lr)
+		listed <- err
+	}()
+
+	go func() {
+		w, err := compress(io.MultiWriter(pw, file), s.compression)
+		if err == nil {
+			_, err = io.Copy(w, io.TeeReader(r, lw))
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		lw.CloseWithError(err)
+		pw.CloseWithError(err)
+	}()
+
+	if err := s.blobs.Put(ctx, narKey(info.NarHash, s.compression), pr); err != nil {
+		pr.CloseWithError(err)
+		return s.abandon(ctx, info, errors.WithMessage(err, "while storing NAR"))
+	}
+
+	if err := <-listed; err != nil {
+		return s.abandon(ctx, info, errors.WithMessage(err, "invalid NAR"))
+	} else if err := s.putListing(ctx, info.NarHash, list); err != nil {
+		return s.abandon(ctx, info, err)
+	}
+
+	info.Compression = s.compression
+	info.FileHash = "sha256:" + nixbase32.EncodeToString(file.hash.Sum(nil))
+	info.FileSize = file.size
+	return nil
+}
+
+// markStaged records that a NAR is being stored for info, until
+// unmarkStaged.
+func (s narStore) markStaged(ctx context.Context, info *validPathInfo) error {
+	return s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if err := lockNar(ctx, tx, info.NarHash, false); err != nil {
+			return err
+		}
+		err := tx.QueryRow(ctx, `
+			INSERT INTO staged_nars (nar_hash, compression) VALUES ($1, $2) RETURNING id;
+		`, info.NarHash, s.compression).Scan(&info.staged)
+		return errors.WithMessage(err, "while marking NAR as staged")
+	})
+}
+
+// unmarkStaged ends what markStaged started for infos.
+func (s narStore) unmarkStaged(ctx context.Context, infos map[string]*validPathInfo) error {
+	ids := []int64{}
+	for _, info := range infos {
+		if info.staged != 0 {
+			ids = append(ids, info.staged)
+			info.staged = 0
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := s.db.Exec(ctx, `DELETE FROM staged_nars WHERE id = ANY($1);`, ids)
+	return errors.WithMessage(err, "while unmarking staged NARs")
+}
+
+// abandon unstages the NAR of info after err, and returns err.
+func (s narStore) abandon(ctx context.Context, info *validPathInfo, err error) error {
+	if unstageErr := s.unstage(ctx, map[string]*validPathInfo{info.OutPath: info}); unstageErr != nil {
+		return errors.WithMessagef(unstageErr, "while cleaning up after %s", err)
+	}
+	return err
+}
+
+// fileHashWriter hashes the NAR file as it's written to the blob store.
+type fileHashWriter struct {
+	hash hash.Hash
+	size uint64
+}
+
+func (w *fileHashWriter) Write(buf []byte) (int, error) {
+	w.size += uint64(len(buf))
+	return w.hash.Write(buf)
+}
+
+// open returns the uncompressed NAR with narHash, regardless of whether it
+// was optimised yet. It fails with storage.ErrNotFound if there is no such NAR.
+func (s narStore) open(ctx context.Context, narHash, compression string) (io.ReadCloser, error) {
+	blob, err := s.blobs.Get(ctx, narKey(narHash, compression), 0, -1)
+	if err == storage.ErrNotFound {
+		if chunked, err := s.openChunked(ctx, narHash); err != storage.ErrNotFound {
+			return chunked, err
+		}
+
+		// The NAR may have been stored again with another compression since
+		// compression was looked up.
+		if err := s.db.QueryRow(ctx, `
+			SELECT compression FROM valid_paths WHERE hash = $1 AND compression <> $2 LIMIT 1;
+		`, narHash, compression).Scan(&compression); err == pgx.ErrNoRows {
+			return nil, storage.ErrNotFound
+		} else if err != nil {
+			return nil, errors.WithMessage(err, "while selecting NAR compression")
+		}
+		blob, err = s.blobs.Get(ctx, narKey(narHash, compression), 0, -1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nar, err := decompress(blob, compression)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: nar, close: func() error { nar.Close(); return blob.Close() }}, nil
+}
+
+// add stores the NAR of info read from nar and makes the path valid. See
+// stage and register.
+func (s narStore) add(ctx context.Context, info *validPathInfo, nar io.Reader, warn func(string)) error {
+	if staged, err := s.stage(ctx, info, nar, warn); err != nil || !staged {
+		return err
+	}
+	return s.register(ctx, map[string]*validPathInfo{info.OutPath: info})
+}
+
+// stage stores the NAR of info read from nar, after checking it against the
+// hash and size in info, without making the path valid yet. If it's valid
+// already, nar is drained and ignored, and false is returned.
+//
+// The NAR is scanned for references on the way. Claimed references it doesn't
+// contain are passed to warn. Valid paths it refers to without claiming them
+// make it fail, unless only warnings were asked for with REFERENCE_CHECK=warn.
+func (s narStore) stage(ctx context.Context, info *validPathInfo, nar io.Reader, warn func(string)) (bool, error) {
+	if valid, err := isValidPath(ctx, s.db, info.OutPath); err != nil {
+		return false, err
+	} else if valid {
+		_, err := io.Copy(io.Discard, nar)
+		return false, err
+	}
+
+	scanner, err := newReferenceScanner(info.References)
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.put(ctx, info, io.TeeReader(newNarHashReader(nar, info.NarHash, info.NarSize), scanner)); err != nil {
+		return false, err
+	}
+
+	if strings.HasPrefix(info.CA, "text:") {
+		if err := s.checkTextContent(ctx, info); err != nil {
+			return false, s.abandon(ctx, info, err)
+		}
+	}
+
+	found, undeclared, err := scanner.found(ctx, s.db, info.OutPath, info.References)
+	if err != nil {
+		return false, s.abandon(ctx, info, err)
+	}
+
+	for _, reference := range uniqueStrings(info.References) {
+		if !contains(found, reference) {
+			warn(fmt.Sprintf("path '%s' claims a reference to '%s', which it doesn't contain", info.OutPath, reference))
+		}
+	}
+
+	if len(undeclared) > 0 && canHaveReferences(info.CA) {
+		problem := fmt.Sprintf("path '%s' refers to '%s' without declaring it", info.OutPath, strings.Join(undeclared, "', '"))
+		if s.warnOnly {
+			warn(problem)
+		} else {
+			return false, s.abandon(ctx, info, errors.New(problem))
+		}
+	}
+
+	return true, nil
+}
+
+// checkTextContent makes sure the stored NAR of a text:sha256 path has the
+// content of its content address, which its path follows from.
+func (s narStore) checkTextContent(ctx context.Context, info *validPathInfo) error {
+	nar, err := s.open(ctx, info.NarHash, info.Compression)
+	if err != nil {
+		return err
+	}
+	defer nar.Close()
+
+	digest, err := textContentHash(nar)
+	if err != nil {
+		return errors.WithMessagef(err, "path '%s'", info.OutPath)
+	} else if ca := "text:sha256:" + nixbase32.EncodeToString(digest); ca != info.CA {
+		return errors.Errorf("path '%s' claims the content address %s, but has %s", info.OutPath, info.CA, ca)
+	}
+	return nil
+}
+
+// register makes the staged infos valid in one transaction, in the order of
+// their references. If that fails, because some of them refer to paths that
+// are neither valid nor among infos, none become valid and their NARs are
+// deleted again.
+func (s narStore) register(ctx context.Context, infos map[string]*validPathInfo) error {
+	err := registerValidPaths(ctx, s.db, sortByReferences(infos))
+	if err == nil {
+		return s.unmarkStaged(ctx, infos)
+	} else if unstageErr := s.unstage(ctx, infos); unstageErr != nil {
+		return errors.WithMessagef(unstageErr, "while cleaning up after %s", err)
+	}
+	return err
+}
+
+// unstage deletes the NARs of staged infos that won't become valid, unless
+// they are used otherwise.
+func (s narStore) unstage(ctx context.Context, infos map[string]*validPathInfo) error {
+	narHashes := make([]string, 0, len(infos))
+	for _, info := range infos {
+		narHashes = append(narHashes, info.NarHash)
+	}
+	if err := s.unmarkStaged(ctx, infos); err != nil {
+		return err
+	}
+	return s.deleteUnused(ctx, narHashes)
+}
+
+// openFile returns the NAR with narHash as stored, still compressed with
+// compression, like the file a narinfo refers to.
+func (s narStore) openFile(ctx context.Context, narHash, compression string) (io.ReadCloser, error) {
+	if compression == "none" {
+		return s.open(ctx, narHash, compression)
+	}
+	return s.blobs.Get(ctx, narKey(narHash, compression), 0, -1)
+}
+
+func (s narStore) putListing(ctx context.Context, narHash string, list *listing) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO nar_listings (nar_hash, listing) VALUES ($1, $2) ON CONFLICT DO NOTHING;
+	`, narHash, list)
+	return errors.WithMessage(err, "while storing NAR listing")
+}
+
+// listing returns the listing of the NAR with narHash. NARs stored before we
+// kept listings are read once to build it.
+func (s narStore) listing(ctx context.Context, narHash, compression string) (*listing, error) {
+	list := &listing{}
+	if err := s.db.QueryRow(ctx, `
+		SELECT listing FROM nar_listings WHERE nar_hash = $1;
+	`, narHash).Scan(list); err == nil {
+		return list, nil
+	} else if err != pgx.ErrNoRows {
+		return nil, errors.WithMessage(err, "while selecting NAR listing")
+	}
+
+	nar, err := s.open(ctx, narHash, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer nar.Close()
+
+	if list, err = narListing(nar); err != nil {
+		return nil, err
+	}
+
+	return list, s.putListing(ctx, narHash, list)
+}
+
+// size returns the stored size of the NAR with narHash without reading it,
+// which is the compressed size unless it was optimised.
+func (s narStore) size(ctx context.Context, narHash, compression string) (int64, error) {
+	if info, err := s.blobs.Stat(ctx, narKey(narHash, compression)); err == nil {
+		return info.Size, nil
+	} else if err != storage.ErrNotFound {
+		return 0, err
+	}
+
+	var size *int64
+	if err := s.db.QueryRow(ctx, `
+		SELECT SUM(chunks.size) FROM nar_chunks JOIN chunks ON chunks.hash = nar_chunks.chunk
+		WHERE nar_chunks.nar_hash = $1;
+	`, narHash).Scan(&size); err != nil {
+		return 0, errors.WithMessage(err, "while summing chunk sizes")
+	} else if size == nil {
+		return 0, storage.ErrNotFound
+	}
+
+	return *size, nil
+}
+
+// deleteUnused deletes the NARs with narHashes that neither valid paths nor
+// uploads use, along with chunks no other NAR needs. NARs still in use with
+// one compression lose their copies in other compressions. The blobs are
+// deleted while holding the lock of the NAR, so nothing starts using them in
+// the meantime.
+func (s narStore) deleteUnused(ctx context.Context, narHashes []string) error {
+	for _, narHash := range uniqueStrings(narHashes) {
+		if err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock_shared($1);`, gcLockID); err != nil {
+				return errors.WithMessage(err, "while waiting for gc")
+			} else if err := lockNar(ctx, tx, narHash, true); err != nil {
+				return err
+			}
+
+			used := []string{}
+			if err := tx.QueryRow(ctx, `
+				SELECT COALESCE(array_agg(DISTINCT compression), '{}') FROM (
+					SELECT compression FROM valid_paths WHERE hash = $1
+					UNION
+					SELECT compression FROM staged_nars WHERE nar_hash = $1 AND created_at > $2
+				) AS used;
+			`, narHash, time.Now().Add(-staleStagingAge)).Scan(&used); err != nil {
+				return errors.WithMessage(err, "while checking NAR usage")
+			}
+
+			chunks := []string{}
+			if len(used) == 0 {
+				if _, err := tx.Exec(ctx, `DELETE FROM nar_listings WHERE nar_hash = $1;`, narHash); err != nil {
+					return errors.WithMessage(err, "while deleting NAR listing")
+				}
+
+				candidates := []string{}
+				if err := pgxscan.Select(ctx, tx, &candidates, `
+					DELETE FROM nar_chunks WHERE nar_hash = $1 RETURNING chunk;
+				`, narHash); err != nil {
+					return errors.WithMessage(err, "while deleting NAR chunks")
+				}
+
+				// optimise locks the rows of the chunks it uses, in order, until
+				// it has recorded them for its NAR. Only a later statement sees
+				// what it recorded, so the rows are locked before checking.
+				if _, err := tx.Exec(ctx, `
+					SELECT 1 FROM chunks WHERE hash = ANY($1) ORDER BY hash FOR UPDATE;
+				`, candidates); err != nil {
+					return errors.WithMessage(err, "while locking chunks")
+				} else if err := pgxscan.Select(ctx, tx, &chunks, `
+					DELETE FROM chunks WHERE hash = ANY($1)
+					AND NOT EXISTS (SELECT 1 FROM nar_chunks WHERE nar_chunks.chunk = chunks.hash)
+					RETURNING hash;
+				`, candidates); err != nil {
+					return errors.WithMessage(err, "while deleting chunks")
+				}
+			}
+
+			for _, compression := range narCompressions {
+				if contains(used, compression) {
+					continue
+				} else if err := s.blobs.Delete(ctx, narKey(narHash, compression)); err != nil && err != storage.ErrNotFound {
+					return errors.WithMessage(err, "while deleting NAR")
+				}
+			}
+
+			for _, chunk := range chunks {
+				if err := s.blobs.Delete(ctx, chunkKey(chunk)); err != nil && err != storage.ErrNotFound {
+					return errors.WithMessage(err, "while deleting chunk")
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// narHashReader hashes everything read through it and fails at EOF if the
+// content doesn't match the expected hash and size.
+type narHashReader struct {
+	from         io.Reader
+	hash         hash.Hash
+	size         uint64
+	expectedHash string
+	expectedSize uint64
+}
+
+func newNarHashReader(from io.Reader, expectedHash string, expectedSize uint64) *narHashReader {
+	return &narHashReader{from: from, hash: sha256.New(), expectedHash: expectedHash, expectedSize: expectedSize}
+}
+
+func (r *narHashReader) Read(buf []byte) (int, error) {
+	n, err := r.from.Read(buf)
+	r.hash.Write(buf[:n])
+	r.size += uint64(n)
+
+	if err == io.EOF {
+		if r.size != r.expectedSize {
+			return n, errors.Errorf("NAR size mismatch: got %d, expected %d", r.size, r.expectedSize)
+		} else if got := r.NarHash(); got != r.expectedHash {
+			return n, errors.Errorf("NAR hash mismatch: got %s, expected %s", got, r.expectedHash)
+		}
+	}
+
+	return n, err
+}
+
+func (r *narHashReader) NarHash() string {
+	return "sha256:" + nixbase32.EncodeToString(r.hash.Sum(nil))
+}
+
+// parseNarHash accepts the base16 NAR hashes of the worker protocol as well as
+// the sha256:<nixbase32> form we store, and returns the latter.
+func parseNarHash(s string) (string, error) {
+	digest := []byte{}
+	var err error
+
+	switch s = strings.TrimPrefix(s, "sha256:"); len(s) {
+	case hex.EncodedLen(sha256.Size):
+		digest, err = hex.DecodeString(s)
+	case nixbase32.EncodedLen(sha256.Size):
+		digest, err = nixbase32.DecodeString(s)
+	default:
+		return "", errors.Errorf("invalid NAR hash: %s", s)
+	}
+
+	if err != nil {
+		return "", errors.WithMessagef(err, "invalid NAR hash: %s", s)
+	}
+
+	return "sha256:" + nixbase32.EncodeToString(digest), nil
+}
+
+func isValidPath(ctx context.Context, db *pgxpool.Pool, storePath string) (bool, error) {
+	var valid bool
+	err := db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM valid_paths WHERE path = $1);`, storePath).Scan(&valid)
+	return valid, errors.WithMessage(err, "while checking path validity")
+}
+
+// pathInfo returns the valid path storePath with its references in order.
+// It returns errNotInCache if there is none.
+func pathInfo(ctx context.Context, db *pgxpool.Pool, storePath string) (*validPathInfo, error) {
+	return selectPathInfo(ctx, db, `path = $1`, storePath)
+}
+
+// selectPathInfo returns the valid path matching condition on arg.
+func selectPathInfo(ctx context.Context, db *pgxpool.Pool, condition string, arg any) (*validPathInfo, error) {
+	info := &validPathInfo{}
+	var id, narSize, fileSize int64
+	var registrationTime *time.Time
+	var deriver, ca *string
+
+	if err := db.QueryRow(ctx, `
+		SELECT id, path, hash, registration_time, COALESCE(nar_size, 0), COALESCE(ultimate, false),
+			deriver, COALESCE(sigs, '{}'), ca, COALESCE(file_hash, hash), COALESCE(file_size, nar_size, 0), compression
+		FROM valid_paths WHERE `+condition+`;
+	`, arg).Scan(
+		&id, &info.OutPath, &info.NarHash, &registrationTime, &narSize, &info.Ultimate,
+		&deriver, &info.Sigs, &ca, &info.FileHash, &fileSize, &info.Compression,
+	); err == pgx.ErrNoRows {
+		return nil, errNotInCache
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "while selecting valid path")
+	}
+
+	info.NarSize, info.FileSize = uint64(narSize), uint64(fileSize)
+	if registrationTime != nil {
+		info.RegistrationTime = *registrationTime
+	}
+	if deriver != nil {
+		info.Deriver = *deriver
+	}
+	if ca != nil {
+		info.CA = *ca
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT valid_paths.path FROM refs JOIN valid_paths ON valid_paths.id = refs.reference
+		WHERE refs.referrer = $1 ORDER BY valid_paths.path;
+	`, id)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while selecting references")
+	}
+	defer rows.Close()
+
+	info.References = []string{}
+	for rows.Next() {
+		var reference string
+		if err := rows.Scan(&reference); err != nil {
+			return nil, errors.WithMessage(err, "while scanning references")
+		}
+		info.References = append(info.References, reference)
+	}
+
+	return info, errors.WithMessage(rows.Err(), "while selecting references")
+}
+
+// allValidPathsBatch is how many paths are fetched from the cursor at once.
+const allValidPathsBatch = 10000
+
+// allValidPaths first calls count with the number of valid paths, then each
+// for every one of them. The paths are read through a cursor from a single
+// snapshot, so the count stays accurate and the store may be arbitrarily large
+// without us holding all of it in memory.
+func allValidPaths(ctx context.Context, db *pgxpool.Pool, count func(uint64) error, each func(string) error) error {
+	options := pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}
+	return db.BeginTxFunc(ctx, options, func(tx pgx.Tx) error {
+		var total int64
+		if err := tx.QueryRow(ctx, `SELECT count(*) FROM valid_paths;`).Scan(&total); err != nil {
+			return errors.WithMessage(err, "while counting valid paths")
+		} else if err := count(uint64(total)); err != nil {
+			return err
+		} else if _, err := tx.Exec(ctx, `DECLARE all_valid_paths NO SCROLL CURSOR FOR SELECT path FROM valid_paths ORDER BY id;`); err != nil {
+			return errors.WithMessage(err, "while declaring cursor")
+		}
+
+		sent := int64(0)
+		for {
+			rows, err := tx.Query(ctx, `FETCH FORWARD `+strconv.Itoa(allValidPathsBatch)+` FROM all_valid_paths;`)
+			if err != nil {
+				return errors.WithMessage(err, "while fetching valid paths")
+			}
+
+			fetched := 0
+			for rows.Next() {
+				var path string
+				if err := rows.Scan(&path); err != nil {
+					rows.Close()
+					return errors.WithMessage(err, "while scanning valid paths")
+				} else if sent++; sent > total {
+					rows.Close()
+					return errors.Errorf("cursor returned more than the %d valid paths counted", total)
+				} else if err := each(path); err != nil {
+					rows.Close()
+					return err
+				}
+				fetched++
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return errors.WithMessage(err, "while fetching valid paths")
+			}
+
+			if fetched == 0 {
+				break
+			}
+		}
+
+		if sent != total {
+			return errors.Errorf("cursor returned %d of the %d valid paths counted", sent, total)
+		}
+
+		return nil
+	})
+}
+
+// registerValidPaths makes infos valid in a single transaction. They must be
+// sorted so that references come before their referrers, and every reference
+// must either be in infos or valid already.
+func registerValidPaths(ctx context.Context, db *pgxpool.Pool, infos []*validPathInfo) error {
+	return db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock_shared($1);`, gcLockID); err != nil {
+			return errors.WithMessage(err, "while waiting for gc")
+		}
+
+		if err := checkClosure(ctx, tx, infos); err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			if err := registerValidPath(ctx, tx, info); err != nil {
+				return errors.WithMessagef(err, "while registering %s", info.OutPath)
+			}
+		}
+
+		return nil
+	})
+}
+
+func registerValidPath(ctx context.Context, tx pgx.Tx, info *validPathInfo) error {
+	var id int64
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO valid_paths (path, hash, registration_time, deriver, nar_size, ultimate, sigs, ca, file_hash, file_size, compression)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, NULLIF($8, ''), $9, $10, $11)
+		ON CONFLICT (path) DO NOTHING
+		RETURNING id;
+	`, info.OutPath, info.NarHash, time.Now(), info.Deriver, int64(info.NarSize), info.Ultimate, info.Sigs, info.CA,
+		info.FileHash, int64(info.FileSize), info.Compression,
+	).Scan(&id); err == pgx.ErrNoRows {
+		return nil // someone else was faster
+	} else if err != nil {
+		return errors.WithMessage(err, "while inserting valid path")
+	}
+
+	references := uniqueStrings(info.References)
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO refs (referrer, reference)
+		SELECT $1, id FROM valid_paths WHERE path = ANY($2);
+	`, id, references)
+	if err != nil {
+		return errors.WithMessage(err, "while inserting references")
+	} else if tag.RowsAffected() != int64(len(references)) {
+		return errors.Errorf("%d of %d references are not valid", int64(len(references))-tag.RowsAffected(), len(references))
+	}
+
+	return nil
+}
+
+var errIncompleteClosure = errors.New("incomplete closure")
+
+// checkClosure returns errIncompleteClosure naming the first reference of infos that is
+// neither valid nor one of infos.
+func checkClosure(ctx context.Context, db pgxscan.Querier, infos []*validPathInfo) error {
+	inBatch := map[string]bool{}
+	outside := []string{}
+	for _, info := range infos {
+		inBatch[info.OutPath] = true
+	}
+	for _, info := range infos {
+		for _, reference := range info.References {
+			if !inBatch[reference] {
+				outside = append(outside, reference)
+			}
+		}
+	}
+	if len(outside) == 0 {
+		return nil
+	}
+
+	valid := []string{}
+	if err := pgxscan.Select(ctx, db, &valid, `
+		SELECT path FROM valid_paths WHERE path = ANY($1);
+	`, uniqueStrings(outside)); err != nil {
+		return errors.WithMessage(err, "while selecting references")
+	}
+
+	for _, info := range infos {
+		for _, reference := range info.References {
+			if !inBatch[reference] && !contains(valid, reference) {
+				return errors.WithMessagef(errIncompleteClosure, "path '%s' refers to '%s', which is not valid", info.OutPath, reference)
+			}
+		}
+	}
+
+	return nil
+}
+
+// sortByReferences orders infos so that every path comes after the paths it
+// refers to. Self-references are ignored.
+func sortByReferences(infos map[string]*validPathInfo) []*validPathInfo {
+	sorted := make([]*validPathInfo, 0, len(infos))
+	visited := map[string]bool{}
+
+	var visit func(string)
+	visit = func(storePath string) {
+		info, ok := infos[storePath]
+		if !ok || visited[storePath] {
+			return
+		}
+		visited[storePath] = true
+		for _, reference := range info.References {
+			visit(reference)
+		}
+		sorted = append(sorted, info)
+	}
+
+	for _, storePath := range sortedKeys(infos) {
+		visit(storePath)
+	}
+
+	return sorted
+}
+
+func uniqueStrings(in []string) []string {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
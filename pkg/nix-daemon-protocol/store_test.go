@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSortByReferences(t *testing.T) {
+	tests := []struct {
+		name  string
+		infos map[string][]string
+		want  string
+	}{
+		{name: "empty", infos: map[string][]string{}, want: ""},
+		{
+			name:  "chain",
+			infos: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {}},
+			want:  "c b a",
+		},
+		{
+			name:  "diamond",
+			infos: map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": {}},
+			want:  "d b c a",
+		},
+		{
+			name:  "self-references and valid references",
+			infos: map[string][]string{"a": {"a", "b", "valid"}, "b": {"b"}},
+			want:  "b a",
+		},
+	}
+
+	for _, test := range tests {
+		infos := map[string]*validPathInfo{}
+		for storePath, references := range test.infos {
+			infos[storePath] = &validPathInfo{OutPath: storePath, References: references}
+		}
+
+		sorted := []string{}
+		for _, info := range sortByReferences(infos) {
+			sorted = append(sorted, info.OutPath)
+		}
+		if got := strings.Join(sorted, " "); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseNarHash(t *testing.T) {
+	const hash = "sha256:1fnf2m46ya7r7afkcb8ba2j0sc4a85m749sh9jz64g4hx6z3r088"
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "08813cbee9903c62be4c5027726a418a300da4500b2d369d3af9286f4815ceba", want: hash},
+		{input: "sha256:08813cbee9903c62be4c5027726a418a300da4500b2d369d3af9286f4815ceba", want: hash},
+		{input: "1fnf2m46ya7r7afkcb8ba2j0sc4a85m749sh9jz64g4hx6z3r088", want: hash},
+		{input: hash, want: hash},
+		{input: ""},
+		{input: "sha256:1fnf2m46ya7r7afkcb8ba2j0sc4a85m7"},
+		{input: "z8813cbee9903c62be4c5027726a418a300da4500b2d369d3af9286f4815ceba"},
+		{input: "efnf2m46ya7r7afkcb8ba2j0sc4a85m749sh9jz64g4hx6z3r088"},
+	}
+
+	for _, test := range tests {
+		got, err := parseNarHash(test.input)
+		if test.want == "" && err == nil {
+			t.Errorf("parseNarHash(%q) = %s, want an error", test.input, got)
+		} else if test.want != "" && got != test.want {
+			t.Errorf("parseNarHash(%q) = %s, %v, want %s", test.input, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/nixpath"
+	"github.com/pkg/errors"
+)
+
+var errNotInCache = errors.New("not in binary cache")
+
+// binaryCache is an upstream substituter, either served over HTTP(S) or a
+// directory in the same layout using a file:// URL.
+type binaryCache struct {
+	url *url.URL
+}
+
+// parseSubstituters parses a space separated list of binary cache URLs, like
+// the substituters option of nix.conf.
+func parseSubstituters(s string) ([]*binaryCache, error) {
+	caches := []*binaryCache{}
+	for _, field := range strings.Fields(s) {
+		u, err := url.Parse(field)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "while parsing substituter '%s'", field)
+		}
+		switch u.Scheme {
+		case "http", "https", "file":
+			caches = append(caches, &binaryCache{url: u})
+		default:
+			return nil, errors.Errorf("unsupported substituter '%s'", field)
+		}
+	}
+	return caches, nil
+}
+
+// parseTrustedPublicKeys parses a space separated list of keys, like the
+// trusted-public-keys option of nix.conf.
+func parseTrustedPublicKeys(s string) ([]signature.PublicKey, error) {
+	keys := []signature.PublicKey{}
+	for _, field := range strings.Fields(s) {
+		key, err := signature.ParsePublicKey(field)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "while parsing public key '%s'", field)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (b *binaryCache) String() string {
+	return b.url.String()
+}
+
+func (b *binaryCache) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if b.url.Scheme == "file" {
+		fd, err := os.Open(filepath.Join(b.url.Path, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			return nil, errNotInCache
+		}
+		return fd, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.JoinPath(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound, http.StatusForbidden:
+		res.Body.Close()
+		return nil, errNotInCache
+	default:
+		res.Body.Close()
+		return nil, errors.Errorf("GET %s: %s", req.URL, res.Status)
+	}
+}
+
+// narInfo fetches the narinfo of storePath. It returns errNotInCache if the
+// cache doesn't have it.
+func (b *binaryCache) narInfo(ctx context.Context, storePath string) (*narinfo.NarInfo, error) {
+	np, err := nixpath.FromString(storePath)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := b.open(ctx, nixbase32.EncodeToString(np.Digest)+".narinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	info, err := narinfo.Parse(body)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "while parsing narinfo of %s from %s", storePath, b)
+	} else if info.NarHash == nil {
+		return nil, errors.Errorf("%s returned narinfo for %s without NarHash", b, storePath)
+	} else if info.StorePath != storePath {
+		return nil, errors.Errorf("%s returned narinfo for %s instead of %s", b, info.StorePath, storePath)
+	}
+
+	return info, nil
+}
+
+// nar returns the uncompressed NAR described by info.
+func (b *binaryCache) nar(ctx context.Context, info *narinfo.NarInfo) (io.ReadCloser, error) {
+	body, err := b.open(ctx, info.URL)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "while fetching %s", info.URL)
+	}
+
+	r, err := decompress(body, info.Compression)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: r, close: func() error { r.Close(); return body.Close() }}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+// substitution is a path found in a substituter, with the narinfo translated
+// into what we store.
+type substitution struct {
+	cache   *binaryCache
+	narinfo *narinfo.NarInfo
+	info    *validPathInfo
+}
+
+// querySubstitutable looks up storePath in the substituters, in order, and
+// returns the first narinfo signed by one of the trusted keys.
+func (c *client) querySubstitutable(ctx context.Context, storePath string) (*substitution, error) {
+	for _, cache := range c.substituters {
+		ni, err := cache.narInfo(ctx, storePath)
+		if err == errNotInCache {
+			continue
+		} else if err != nil {
+			c.debug("substituter", cache.String(), "failed:", err.Error())
+			continue
+		}
+
+		if !signature.VerifyFirst(ni.Fingerprint(), ni.Signatures, c.trustedKeys) {
+			c.debug("ignoring unsigned", storePath, "from", cache.String())
+			continue
+		}
+
+		return &substitution{cache: cache, narinfo: ni, info: pathInfoFromNarInfo(ni)}, nil
+	}
+
+	return nil, errNotInCache
+}
+
+// pathInfoFromNarInfo translates ni into what we store, without anything
+// about the file, which depends on how we store the NAR.
+func pathInfoFromNarInfo(ni *narinfo.NarInfo) *validPathInfo {
+	info := &validPathInfo{
+		OutPath:    ni.StorePath,
+		NarHash:    ni.NarHash.NixString(),
+		NarSize:    ni.NarSize,
+		References: make([]string, 0, len(ni.References)),
+		CA:         ni.CA,
+	}
+	if ni.Deriver != "" {
+		info.Deriver = nixpath.Absolute(ni.Deriver)
+	}
+	for _, reference := range ni.References {
+		info.References = append(info.References, nixpath.Absolute(reference))
+	}
+	for _, sig := range ni.Signatures {
+		info.Sigs = append(info.Sigs, sig.String())
+	}
+	return info
+}
+
+// substitutablePaths returns the paths at least one substituter has a
+// trusted narinfo for.
+func (c *client) substitutablePaths(ctx context.Context, paths []string) ([]string, error) {
+	substitutable := []string{}
+	for _, storePath := range paths {
+		if _, err := c.querySubstitutable(ctx, storePath); err == nil {
+			substitutable = append(substitutable, storePath)
+		} else if err != errNotInCache {
+			return nil, err
+		}
+	}
+	return substitutable, nil
+}
+
+// missingClosure returns the substitutions needed to make storePath and
+// everything it refers to valid. It fails with errNotInCache-like errors if
+// some part of the closure is neither valid nor substitutable.
+func (c *client) missingClosure(ctx context.Context, storePath string) (map[string]*substitution, error) {
+	missing := map[string]*substitution{}
+	seen := map[string]bool{}
+	queue := []string{storePath}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+
+		if valid, err := isValidPath(ctx, c.db, current); err != nil {
+			return nil, err
+		} else if valid {
+			continue
+		}
+
+		sub, err := c.querySubstitutable(ctx, current)
+		if err == errNotInCache {
+			return nil, errors.WithMessagef(err, "path '%s' is required, but there is no substituter that can build it", current)
+		} else if err != nil {
+			return nil, err
+		}
+
+		missing[current] = sub
+		queue = append(queue, sub.info.References...)
+	}
+
+	return missing, nil
+}
+
+// substituteClosure makes storePath and everything it refers to valid,
+// fetching whatever is missing from the substituters.
+func (c *client) substituteClosure(ctx context.Context, storePath string) error {
+	missing, err := c.missingClosure(ctx, storePath)
+	if err != nil {
+		return err
+	}
+
+	infos := map[string]*validPathInfo{}
+	for path, sub := range missing {
+		if err := c.fetchNar(ctx, sub); err != nil {
+			if unstageErr := c.nars.unstage(ctx, infos); unstageErr != nil {
+				c.debug("unstaging failed:", unstageErr)
+			}
+			return errors.WithMessagef(err, "while substituting %s", path)
+		}
+		infos[path] = sub.info
+	}
+
+	return c.nars.register(ctx, infos)
+}
+
+func (c *client) fetchNar(ctx context.Context, sub *substitution) error {
+	c.debug("copying", sub.info.OutPath, "from", sub.cache.String())
+
+	nar, err := sub.cache.nar(ctx, sub.narinfo)
+	if err != nil {
+		return err
+	}
+	defer nar.Close()
+
+	return c.nars.put(ctx, sub.info, newNarHashReader(nar, sub.info.NarHash, sub.info.NarSize))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// liveSessions selects the ids of sessions whose database connection is still
+// open. Sessions of crashed processes drop out of it as soon as Postgres
+// notices the disconnect.
+const liveSessions = `
+	SELECT sessions.id FROM sessions
+	JOIN pg_stat_activity
+		ON pg_stat_activity.pid = sessions.backend_pid
+		AND pg_stat_activity.backend_start = sessions.backend_start
+`
+
+// session ties temporary roots to the lifetime of a client connection. It
+// holds on to a connection of the pool until it ends.
+type session struct {
+	id   int64
+	conn *pgxpool.Conn
+}
+
+func startSession(ctx context.Context, db *pgxpool.Pool, identity Identity) (*session, error) {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while acquiring session connection")
+	}
+
+	s := &session{conn: conn}
+	if err := conn.QueryRow(ctx, `
+		INSERT INTO sessions (github_user, ssh_user, key_fingerprint, backend_pid, backend_start)
+		SELECT $1, NULLIF($2, ''), NULLIF($3, ''), pid, backend_start FROM pg_stat_activity WHERE pid = pg_backend_pid()
+		RETURNING id;
+	`, identity.User(), identity.SSHUser, identity.KeyFingerprint).Scan(&s.id); err != nil {
+		conn.Release()
+		return nil, errors.WithMessage(err, "while inserting session")
+	}
+
+	return s, nil
+}
+
+// end drops the session and with it all its temporary roots.
+func (s *session) end(ctx context.Context) error {
+	defer s.conn.Release()
+	_, err := s.conn.Exec(ctx, `DELETE FROM sessions WHERE id = $1;`, s.id)
+	return errors.WithMessage(err, "while deleting session")
+}
+
+// addTempRoot protects storePath from being collected until the session
+// ends. It waits for a running collection to finish, so the root is
+// guaranteed to be seen by the next one.
+func (s *session) addTempRoot(ctx context.Context, storePath string) error {
+	return s.conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock_shared($1);`, gcLockID); err != nil {
+			return errors.WithMessage(err, "while waiting for gc")
+		} else if _, err := tx.Exec(ctx, `
+			INSERT INTO temp_roots (session, path) VALUES ($1, $2) ON CONFLICT DO NOTHING;
+		`, s.id, storePath); err != nil {
+			return errors.WithMessage(err, "while inserting temp root")
+		}
+		return nil
+	})
+}
+
+// syncWithGC blocks until no collection is running.
+func (s *session) syncWithGC(ctx context.Context) error {
+	return s.conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock_shared($1);`, gcLockID)
+		return errors.WithMessage(err, "while waiting for gc")
+	})
+}
+
+type tempRoot struct {
+	Session int64  `db:"session"`
+	Path    string `db:"path"`
+}
+
+// Link mimics the `{temp:<pid>}` entries of a local nix-daemon.
+func (r tempRoot) Link() string {
+	return fmt.Sprintf("{temp:%d}", r.Session)
+}
+
+// findTempRoots returns the valid temporary roots of the live sessions of
+// owner, or of all users if owner is empty.
+func findTempRoots(ctx context.Context, db *pgxpool.Pool, owner string) ([]tempRoot, error) {
+	roots := []tempRoot{}
+	if err := pgxscan.Select(ctx, db, &roots, `
+		SELECT temp_roots.session, temp_roots.path
+		FROM temp_roots
+		JOIN valid_paths ON valid_paths.path = temp_roots.path
+		JOIN sessions ON sessions.id = temp_roots.session
+		WHERE temp_roots.session IN (`+liveSessions+`) AND ($1 = '' OR sessions.github_user = $1)
+		ORDER BY temp_roots.session, temp_roots.path;
+	`, owner); err != nil {
+		return nil, errors.WithMessage(err, "while selecting temp roots")
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/wire"
+	"github.com/pkg/errors"
+)
+
+// Values of the trust flag sent in the handshake since protocol 1.35.
+const (
+	trustedFlagUnknown    = 0
+	trustedFlagTrusted    = 1
+	trustedFlagNotTrusted = 2
+)
+
+// untrustedSettings may be overridden by untrusted users in nix-daemon. None
+// of them mean anything here, so they are just accepted quietly.
+var untrustedSettings = []string{"build-timeout", "max-silent-time", "poll-interval", "connect-timeout"}
+
+// setOptions reads the settings of the client. The only one we act on is
+// require-sigs, which only trusted users may turn off, like in nix-daemon.
+func (c *client) setOptions() {
+	for i := 0; i < 12; i++ {
+		_ = c.readInt() // keepFailed, keepGoing, tryFallback, verbosity, ...
+	}
+
+	overrides := map[string]string{}
+	if c.clientVersion&0xff >= 12 {
+		for n := c.readInt(); n > 0 && c.err == nil; n-- {
+			name := c.readString(1024)
+			overrides[name] = c.readString(1024 * 64)
+		}
+	}
+	c.debug("setOptions:", overrides)
+
+	for _, name := range sortedKeys(overrides) {
+		switch {
+		case !c.identity.Trusted && !contains(untrustedSettings, name):
+			c.writeStderrNext(fmt.Sprintf("warning: ignoring the client-specified setting '%s', because it is a restricted setting and you are not a trusted user", name))
+		case name == "require-sigs":
+			if requireSigs, err := strconv.ParseBool(overrides[name]); err == nil {
+				c.requireSigs = requireSigs
+			}
+		}
+	}
+
+	c.writeStderrLast()
+}
+
+// writeTrustedFlag tells clients of protocol 1.35 and later in the handshake
+// whether they are trusted.
+func (c *client) writeTrustedFlag() error {
+	if c.clientVersion&0xff < 35 {
+		return nil
+	} else if c.identity.Trusted {
+		return wire.WriteUint64(c.stdout, trustedFlagTrusted)
+	}
+	return wire.WriteUint64(c.stdout, trustedFlagNotTrusted)
+}
+
+// checkSignature makes sure info is signed by one of the trusted keys, or is
+// content-addressed so its path proves its content, like require-sigs does in
+// nix-daemon. Trusted users can skip that with dontCheckSigs or require-sigs =
+// false, or when there are no trusted keys to check against. Untrusted users
+// can't add anything else, and can't claim paths to be ultimately trusted.
+func (c *client) checkSignature(info *validPathInfo, dontCheckSigs bool) error {
+	if c.identity.Trusted && (dontCheckSigs || !c.requireSigs || len(c.trustedKeys) == 0) {
+		return nil
+	}
+
+	if !c.identity.Trusted {
+		info.Ultimate = false
+	}
+	return verifySignature(info, c.trustedKeys)
+}
+
+// verifySignature makes sure info is content-addressed or signed by one of
+// trustedKeys.
+func verifySignature(info *validPathInfo, trustedKeys []signature.PublicKey) error {
+	if isContentAddressed(info) {
+		return nil
+	}
+
+	sigs := []signature.Signature{}
+	for _, sig := range info.Sigs {
+		if parsed, err := signature.ParseSignature(sig); err == nil {
+			sigs = append(sigs, parsed)
+		}
+	}
+
+	if len(trustedKeys) == 0 || !signature.VerifyFirst(fingerprint(info), sigs, trustedKeys) {
+		return errors.Errorf("cannot add path '%s' because it lacks a signature by a trusted key", info.OutPath)
+	}
+	return nil
+}
+
+// fingerprint is what nix signs for a path.
+func fingerprint(info *validPathInfo) string {
+	references := append([]string{}, info.References...)
+	sort.Strings(references)
+	return "1;" + info.OutPath + ";" + info.NarHash + ";" + strconv.FormatUint(info.NarSize, 10) + ";" + strings.Join(references, ",")
+}
+
+// isContentAddressed is whether the path of info follows from its content
+// address and references. That's the case for fixed:r:sha256, where the
+// content address is the NAR hash, and for text:sha256, like derivations,
+// whose content stage checks against the content address.
+func isContentAddressed(info *validPathInfo) bool {
+	var method *contentAddressMethod
+	digest := strings.TrimPrefix(info.CA, "fixed:r:sha256:")
+	if digest != info.CA && "sha256:"+digest == info.NarHash {
+		method = &contentAddressMethod{recursive: true, algorithm: "sha256"}
+	} else if digest = strings.TrimPrefix(info.CA, "text:sha256:"); digest != info.CA {
+		method = &contentAddressMethod{text: true, algorithm: "sha256"}
+	} else {
+		return false
+	}
+
+	decoded, err := nixbase32.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+
+	name := path.Base(info.OutPath)
+	if i := strings.IndexByte(name, '-'); i >= 0 {
+		name = name[i+1:]
+	}
+
+	// Self-references would need to be hashed differently.
+	if contains(info.References, info.OutPath) {
+		return false
+	}
+	references := append([]string{}, info.References...)
+	sort.Strings(references)
+
+	return method.storePath(name, decoded, references) == info.OutPath
+}
+
+// textContentHash returns the sha256 of the contents of a NAR holding a
+// single regular file, which is what text:sha256 content addresses.
+func textContentHash(r io.Reader) ([]byte, error) {
+	nr, err := nar.NewReader(r)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while reading NAR")
+	}
+	defer nr.Close()
+
+	header, err := nr.Next()
+	if err != nil {
+		return nil, errors.WithMessage(err, "while reading NAR")
+	} else if header.Type != nar.TypeRegular || header.Executable {
+		return nil, errors.New("text content must be a single regular file")
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, nr); err != nil {
+		return nil, errors.WithMessage(err, "while reading NAR")
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+func TestIsContentAddressed(t *testing.T) {
+	fooDigest := sha256.Sum256([]byte(fooDrv))
+	fooCA := "text:sha256:" + nixbase32.EncodeToString(fooDigest[:])
+	barHash := "1fnf2m46ya7r7afkcb8ba2j0sc4a85m749sh9jz64g4hx6z3r088"
+	bar := "/nix/store/4q0pg5zpfmznxscq3avycvf9xdvx50n3-bar"
+
+	tests := []struct {
+		name string
+		info validPathInfo
+		want bool
+	}{
+		{name: "recursive sha256", info: validPathInfo{OutPath: bar, CA: "fixed:r:sha256:" + barHash, NarHash: "sha256:" + barHash}, want: true},
+		{name: "recursive sha256 of another NAR", info: validPathInfo{OutPath: bar, CA: "fixed:r:sha256:" + barHash, NarHash: "sha256:" + fooCA[len("text:sha256:"):]}},
+		{name: "recursive sha1", info: validPathInfo{OutPath: "/nix/store/mp57d33657rf34lzvlbpfa1gjfv5gmpg-bar", CA: "fixed:r:sha1:6f5dlxf2bcy7zm0dbp4xn3rzxaswgvhb"}},
+		{name: "self-reference", info: validPathInfo{OutPath: bar, CA: "fixed:r:sha256:" + barHash, NarHash: "sha256:" + barHash, References: []string{bar}}},
+		{name: "input addressed", info: validPathInfo{OutPath: bar, NarHash: "sha256:" + barHash}},
+		{name: "derivation", info: validPathInfo{OutPath: fooDrvPath, CA: fooCA, References: []string{barDrvPath}}, want: true},
+		{name: "derivation with a reference left out", info: validPathInfo{OutPath: fooDrvPath, CA: fooCA}},
+		{name: "derivation with another reference", info: validPathInfo{OutPath: fooDrvPath, CA: fooCA, References: []string{barDrvPath, bar}}},
+		{name: "derivation at another path", info: validPathInfo{OutPath: barDrvPath, CA: fooCA, References: []string{barDrvPath}}},
+	}
+
+	for _, test := range tests {
+		if got := isContentAddressed(&test.info); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTextContentHash(t *testing.T) {
+	want := sha256.Sum256([]byte(barDrv))
+
+	tests := []struct {
+		name    string
+		entries []narEntry
+		valid   bool
+	}{
+		{name: "regular file", entries: []narEntry{{header: nar.Header{Path: "/", Type: nar.TypeRegular}, contents: barDrv}}, valid: true},
+		{name: "executable", entries: []narEntry{{header: nar.Header{Path: "/", Type: nar.TypeRegular, Executable: true}, contents: barDrv}}},
+		{name: "symlink", entries: []narEntry{{header: nar.Header{Path: "/", Type: nar.TypeSymlink, LinkTarget: barDrvPath}}}},
+	}
+
+	for _, test := range tests {
+		got, err := textContentHash(bytes.NewReader(makeNar(t, test.entries...)))
+		if test.valid && (err != nil || !bytes.Equal(got, want[:])) {
+			t.Errorf("%s: got %x, %v, want %x", test.name, got, err, want)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: got %x, want an error", test.name, got)
+		}
+	}
+}
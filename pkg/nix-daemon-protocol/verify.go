@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/input-output-hk/nix-daemon-server/pkg/storage"
+	"github.com/pkg/errors"
+)
+
+// verifyPageSize is how many valid paths verifyValidPaths selects at once.
+const verifyPageSize = 1000
+
+// verifyValidPaths checks every valid path for a stored NAR of the right
+// size, or, with checkContents, the right hash. Problems are reported to the
+// client as log messages. With repair, damaged NARs are fetched again from
+// the substituters. Paths referring to damaged ones are reported too, as
+// their closures are incomplete. It returns whether any problems remain.
+func (c *client) verifyValidPaths(ctx context.Context, checkContents, repair bool) (bool, error) {
+	damaged := []string{}
+
+	c.writeStderrNext("checking path existence...")
+	if checkContents {
+		c.writeStderrNext("checking hashes...")
+	}
+
+	// Paths are selected in pages and no rows are kept open while checking,
+	// as verifyNar and repairNar need connections of their own.
+	for after := ""; ; {
+		infos := []*validPathInfo{}
+		rows, err := c.db.Query(ctx, `
+			SELECT path, hash, COALESCE(nar_size, 0), compression, COALESCE(file_size, 0) FROM valid_paths
+			WHERE path > $1 ORDER BY path LIMIT $2;
+		`, after, verifyPageSize)
+		if err != nil {
+			return false, errors.WithMessage(err, "while selecting valid paths")
+		}
+		for rows.Next() {
+			info := &validPathInfo{}
+			var narSize, fileSize int64
+			if err := rows.Scan(&info.OutPath, &info.NarHash, &narSize, &info.Compression, &fileSize); err != nil {
+				rows.Close()
+				return false, errors.WithMessage(err, "while scanning valid paths")
+			}
+			info.NarSize = uint64(narSize)
+			info.FileSize = uint64(fileSize)
+			infos = append(infos, info)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return false, errors.WithMessage(err, "while selecting valid paths")
+		} else if len(infos) == 0 {
+			break
+		}
+		after = infos[len(infos)-1].OutPath
+
+		for _, info := range infos {
+			problem := c.verifyNar(ctx, info, checkContents)
+			if problem == nil {
+				continue
+			}
+
+			c.writeStderrNext(problem.Error())
+			if !repair {
+				damaged = append(damaged, info.OutPath)
+			} else if err := c.repairNar(ctx, info); err != nil {
+				c.writeStderrNext(fmt.Sprintf("cannot repair path '%s': %s", info.OutPath, err))
+				damaged = append(damaged, info.OutPath)
+			} else {
+				c.writeStderrNext(fmt.Sprintf("repaired path '%s'", info.OutPath))
+			}
+		}
+	}
+
+	if len(damaged) == 0 {
+		return false, nil
+	}
+
+	c.writeStderrNext("checking references...")
+	referrers, err := c.db.Query(ctx, `
+		SELECT referrer.path, reference.path FROM refs
+		JOIN valid_paths AS referrer ON referrer.id = refs.referrer
+		JOIN valid_paths AS reference ON reference.id = refs.reference
+		WHERE reference.path = ANY($1) AND referrer.id <> reference.id
+		ORDER BY referrer.path, reference.path;
+	`, damaged)
+	if err != nil {
+		return true, errors.WithMessage(err, "while selecting referrers of damaged paths")
+	}
+	defer referrers.Close()
+
+	for referrers.Next() {
+		var referrer, reference string
+		if err := referrers.Scan(&referrer, &reference); err != nil {
+			return true, errors.WithMessage(err, "while scanning referrers of damaged paths")
+		}
+		c.writeStderrNext(fmt.Sprintf("path '%s' refers to damaged path '%s'", referrer, reference))
+	}
+
+	return true, errors.WithMessage(referrers.Err(), "while selecting referrers of damaged paths")
+}
+
+func (c *client) verifyNar(ctx context.Context, info *validPathInfo, checkContents bool) error {
+	if !checkContents {
+		if size, err := c.nars.size(ctx, info.NarHash, info.Compression); err == storage.ErrNotFound {
+			return errors.Errorf("NAR of path '%s' disappeared", info.OutPath)
+		} else if err != nil {
+			return errors.WithMessagef(err, "NAR of path '%s' is unreadable", info.OutPath)
+		} else if uint64(size) != info.FileSize {
+			return errors.Errorf("NAR of path '%s' has size %d, expected %d", info.OutPath, size, info.FileSize)
+		}
+		return nil
+	}
+
+	nar, err := c.nars.open(ctx, info.NarHash, info.Compression)
+	if err == storage.ErrNotFound {
+		return errors.Errorf("NAR of path '%s' disappeared", info.OutPath)
+	} else if err != nil {
+		return errors.WithMessagef(err, "NAR of path '%s' is unreadable", info.OutPath)
+	}
+	defer nar.Close()
+
+	if _, err := io.Copy(io.Discard, newNarHashReader(nar, info.NarHash, info.NarSize)); err != nil {
+		return errors.WithMessagef(err, "path '%s' was modified", info.OutPath)
+	}
+
+	return nil
+}
+
+// repairNar replaces the NAR of info with one from a substituter, as long as
+// it has the hash we registered. The new NAR is stored with the current
+// compression, which may differ from the one the path was added with.
+func (c *client) repairNar(ctx context.Context, info *validPathInfo) error {
+	sub, err := c.querySubstitutable(ctx, info.OutPath)
+	if err != nil {
+		return err
+	} else if sub.info.NarHash != info.NarHash {
+		return errors.Errorf("%s has hash %s instead of %s", sub.cache, sub.info.NarHash, info.NarHash)
+	} else if err := c.fetchNar(ctx, sub); err != nil {
+		return err
+	}
+
+	// Once the path uses the new NAR, unstaging it only deletes the blob of
+	// the old compression.
+	repaired := map[string]*validPathInfo{info.OutPath: sub.info}
+	if sub.info.Compression != info.Compression {
+		if _, err := c.db.Exec(ctx, `
+			UPDATE valid_paths SET file_hash = $2, file_size = $3, compression = $4 WHERE path = $1;
+		`, info.OutPath, sub.info.FileHash, int64(sub.info.FileSize), sub.info.Compression); err != nil {
+			return c.nars.abandon(ctx, sub.info, errors.WithMessage(err, "while updating NAR file"))
+		}
+	}
+
+	return c.nars.unstage(ctx, repaired)
+}
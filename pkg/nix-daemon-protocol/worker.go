@@ -1,70 +1,57 @@
-package main
+package protocol
 
 import (
 	"context"
-	"fmt"
 	"io"
-	"os"
+	"path"
+	"strings"
 	"time"
 
-	"github.com/georgysavva/scany/pgxscan"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/kr/pretty"
-	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixpath"
 	"github.com/nix-community/go-nix/pkg/wire"
 	"github.com/pkg/errors"
 )
 
 const (
 	StderrLast      = 0x616C7473 // stla
+	StderrNext      = 0x6F6C6D67 // gmlo
 	StderrError     = 0x63787470 // ptxc
 	WorkerMagic1    = 0x6E697863 // cxin
 	WorkerMagic2    = 0x6478696F // ioxd
-	ProtocolVersion = 1<<8 | 34  // 1.34
+	ProtocolVersion = 1<<8 | 35  // 1.35
 )
 
-func main() {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		panic("no DATABASE_URL set")
-	}
-
-	dbConfig, err := pgxpool.ParseConfig(dbURL)
-	if err != nil {
-		panic(err)
-	}
-
-	db, err := pgxpool.ConnectConfig(context.Background(), dbConfig)
-	if err != nil {
-		panic(err)
-	}
-
-	c := client{
-		stdin:  os.Stdin,
-		stdout: os.Stdout,
-		stderr: os.Stderr,
-		db:     db,
-	}
-
-	defer func() {
-		if r := recover(); r != nil {
-			panic(r)
-		}
-	}()
-
-	if err := c.handshake(); err != nil {
-		panic(err)
-	} else if err := c.handleOperations(); err != nil {
-		panic(err)
-	}
-}
-
 type client struct {
-	db     *pgxpool.Pool
-	stdin  io.Reader
-	stdout io.Writer
-	stderr io.Writer
-	err    error
+	ctx      context.Context
+	db       *pgxpool.Pool
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	err      error
+	identity Identity
+	policy   *policy
+	session  *session
+
+	clientVersion uint64
+
+	nars         narStore
+	substituters []*binaryCache
+	trustedKeys  []signature.PublicKey
+
+	// requireSigs can be turned off by trusted users with SetOptions.
+	requireSigs bool
+
+	// workDone is set once the current operation started sending its result,
+	// after which errors can't be reported anymore.
+	workDone bool
+
+	// lastTempRoot is the target of an AddIndirectRoot right after the
+	// AddTempRoot that set it, since we can't follow the symlink the client
+	// created on its side. Any other operation clears it.
+	lastTempRoot string
 }
 
 func (c *client) handshake() error {
@@ -76,16 +63,18 @@ func (c *client) handshake() error {
 		return errors.WithMessage(err, "while writing worker magic 2")
 	} else if err := wire.WriteUint64(c.stdout, ProtocolVersion); err != nil {
 		return errors.WithMessage(err, "while writing server protocol version")
-	} else if clientProtocolVersion, err := wire.ReadUint64(c.stdin); err != nil {
+	} else if c.clientVersion, err = wire.ReadUint64(c.stdin); err != nil {
 		return errors.WithMessage(err, "while reading client protocol version")
 	} else if err := wire.WriteString(c.stdout, "2.11.2"); err != nil {
 		return errors.WithMessage(err, "while writing nix version")
+	} else if err := c.writeTrustedFlag(); err != nil {
+		return errors.WithMessage(err, "while writing trusted flag")
 	} else if err := wire.WriteUint64(c.stdout, StderrLast); err != nil {
 		return errors.WithMessage(err, "while writing StderrLast")
 	} else {
 		_, _ = wire.ReadUint64(c.stdin) // cpu affinity
 		_, _ = wire.ReadUint64(c.stdin) // reserve space
-		io.WriteString(c.stderr, pretty.Sprint(clientProtocolVersion)+"\n")
+		io.WriteString(c.stderr, pretty.Sprint(c.clientVersion)+"\n")
 	}
 
 	return nil
@@ -101,90 +90,356 @@ func (c *client) handleOperations() error {
 			return errors.WithMessage(err, "while reading operation")
 		} else {
 			workerOperation := WorkerOperation(operation)
-			io.WriteString(c.stderr, workerOperation.String()+"\n")
-
-			switch workerOperation {
-			case WOPQueryValidPaths:
-				c.queryValidPaths()
-			case WOPRegisterDrvOutput:
-				c.registerDrvOutput()
-			case WOPAddMultipleToStore:
-				c.addMultipleToStore()
-			case WOPAddTempRoot:
-				c.addTempRoot()
-			case WOPQueryMissing:
-				c.queryMissing()
-			case WOPIsValidPath:
-				c.isValidPath()
-			case WOPQueryPathInfo:
-				c.queryPathInfo()
-			default:
-				return errors.Errorf("unknown operation: %s", workerOperation.String())
+			io.WriteString(c.stderr, c.identity.String()+": "+workerOperation.String()+"\n")
+
+			c.workDone = false
+			if !c.policy.allows(c.identity, workerOperation) {
+				c.err = errors.Errorf("user '%s' is not allowed to use %s", c.identity.User(), workerOperation.String())
+			} else {
+				switch workerOperation {
+				case WOPSetOptions:
+					c.setOptions()
+				case WOPQueryValidPaths:
+					c.queryValidPaths()
+				case WOPRegisterDrvOutput:
+					c.registerDrvOutput()
+				case WOPAddToStore:
+					c.addCAToStore()
+				case WOPAddMultipleToStore:
+					c.addMultipleToStore()
+				case WOPAddTempRoot:
+					c.addTempRoot()
+				case WOPAddIndirectRoot:
+					c.addIndirectRoot()
+				case WOPFindRoots:
+					c.findRoots()
+				case WOPSyncWithGC:
+					c.syncWithGC()
+				case WOPCollectGarbage:
+					c.collectGarbage()
+				case WOPQueryMissing:
+					c.queryMissing()
+				case WOPIsValidPath:
+					c.isValidPath()
+				case WOPEnsurePath:
+					c.ensurePath()
+				case WOPQuerySubstitutablePaths:
+					c.querySubstitutablePaths()
+				case WOPQuerySubstitutablePathInfos:
+					c.querySubstitutablePathInfos()
+				case WOPVerifyStore:
+					c.verifyStore()
+				case WOPOptimiseStore:
+					c.optimiseStore()
+				case WOPNarFromPath:
+					c.narFromPath()
+				case WOPQueryAllValidPaths:
+					c.queryAllValidPaths()
+				case WOPQueryPathInfo:
+					c.queryPathInfo()
+				default:
+					c.err = errors.Errorf("unknown operation: %s", workerOperation.String())
+				}
 			}
 
 			if c.err != nil {
-				return err
+				c.writeStderrError(c.err)
+				return c.err
+			} else if workerOperation != WOPAddTempRoot {
+				c.lastTempRoot = ""
 			}
 		}
 	}
 }
 
+// queryPathInfo answers whether storePath is valid, followed by its
+// ValidPathInfo if it is.
 func (c *client) queryPathInfo() {
 	storePath := c.readString(1024 * 4)
 	c.debug("queryPathInfo:", storePath)
 
+	var info *validPathInfo
 	if c.err == nil {
-		info := validPathInfo{}
-		if err := pgxscan.Select(
-			context.Background(), c.db, &info, `SELECT * FROM ValidPaths WHERE path = $1;`, storePath,
-		); err != nil {
+		var err error
+		if info, err = pathInfo(c.ctx, c.db, storePath); err != nil && err != errNotInCache {
 			c.err = err
 		}
 	}
 
 	c.writeStderrLast()
-	c.writeBool(true)
+	c.writeBool(info != nil)
+	if info != nil {
+		c.writeValidPathInfo(info)
+	}
 }
 
 func (c *client) queryValidPaths() {
 	paths := c.readStrings()
 	substitute := c.readBool()
-	c.writeStderrLast()
-	c.writeStrings([]string{})
 	c.debug("paths:", paths, "substitute:", substitute)
+
+	valid := []string{}
+	for _, storePath := range paths {
+		if c.err != nil {
+			break
+		}
+
+		// Like in ensurePath, the temporary root keeps substituted paths
+		// from being collected before the client uses them.
+		if substitute {
+			if err := c.session.addTempRoot(c.ctx, storePath); err != nil {
+				c.err = err
+			} else if err := c.substituteClosure(c.ctx, storePath); err != nil && !errors.Is(err, errNotInCache) {
+				c.err = err
+			}
+		}
+
+		if ok, err := isValidPath(c.ctx, c.db, storePath); err != nil {
+			c.err = err
+		} else if ok {
+			valid = append(valid, storePath)
+		}
+	}
+
+	c.writeStderrLast()
+	c.writeStrings(valid)
+}
+
+func (c *client) queryAllValidPaths() {
+	c.debug("queryAllValidPaths")
+
+	if c.err == nil {
+		c.err = allValidPaths(c.ctx, c.db,
+			func(count uint64) error {
+				c.writeStderrLast()
+				c.writeInt(count)
+				return c.err
+			},
+			func(path string) error {
+				c.writeString(path)
+				return c.err
+			})
+	}
 }
 
 func (c *client) isValidPath() {
 	storePath := c.readString(1024 * 4)
 	c.debug("isValidPath:", storePath)
+
+	valid := false
+	if c.err == nil {
+		valid, c.err = isValidPath(c.ctx, c.db, storePath)
+	}
+
 	c.writeStderrLast()
-	c.writeBool(true)
+	c.writeBool(valid)
+}
+
+func (c *client) ensurePath() {
+	storePath := c.readString(1024 * 4)
+	c.debug("ensurePath:", storePath)
+
+	if c.err == nil {
+		c.err = c.session.addTempRoot(c.ctx, storePath)
+	}
+
+	if c.err == nil {
+		c.err = c.substituteClosure(c.ctx, storePath)
+	}
+
+	c.writeStderrLast()
+	c.writeInt(1)
 }
 
 func (c *client) addTempRoot() {
 	storePath := c.readString(1024 * 4)
 	c.debug("tmproot:", storePath)
+	c.lastTempRoot = storePath
+
+	if c.err == nil {
+		c.err = c.session.addTempRoot(c.ctx, storePath)
+	}
+
+	c.writeStderrLast()
+	c.writeInt(1)
+}
+
+// addIndirectRoot makes a permanent root called name. Nix adds a temporary
+// root for the target right before, so that's used, unless name is a store
+// path itself. Anything else is rejected, as the target would be a guess.
+func (c *client) addIndirectRoot() {
+	name := c.readString(1024 * 4)
+	target := c.lastTempRoot
+	if _, err := nixpath.FromString(name); err == nil {
+		target, name = name, path.Base(name)
+	}
+	c.debug("indirect root:", name, "->", target)
+
+	if c.err == nil {
+		if target == "" {
+			c.err = errors.Errorf("no temporary root added right before indirect root '%s'", name)
+		} else {
+			c.err = addPermRoot(c.ctx, c.db, c.identity.User(), name, target)
+		}
+	}
+
+	c.writeStderrLast()
+	c.writeInt(1)
+}
+
+func (c *client) findRoots() {
+	roots, err := findRoots(c.ctx, c.db, rootOwner(c.identity))
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+
+	tempRoots, err := findTempRoots(c.ctx, c.db, rootOwner(c.identity))
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+
+	c.writeStderrLast()
+	c.writeInt(uint64(len(roots) + len(tempRoots)))
+	for _, root := range roots {
+		c.writeString(root.Link())
+		c.writeString(root.Path)
+	}
+	for _, root := range tempRoots {
+		c.writeString(root.Link())
+		c.writeString(root.Path)
+	}
+}
+
+func (c *client) syncWithGC() {
+	if c.err == nil {
+		c.err = c.session.syncWithGC(c.ctx)
+	}
+
 	c.writeStderrLast()
 	c.writeInt(1)
 }
 
+func (c *client) collectGarbage() {
+	options := gcOptions{action: gcAction(c.readInt())}
+	options.pathsToDelete = c.readStrings()
+	ignoreLiveness := c.readBool()
+	options.maxFreed = c.readInt()
+	_ = c.readInt() // obsolete
+	_ = c.readInt() // obsolete
+	_ = c.readInt() // obsolete
+	c.debug("gc:", options, "ignoreLiveness:", ignoreLiveness)
+
+	results := &gcResults{paths: []string{}}
+	if c.err == nil {
+		if ignoreLiveness {
+			c.err = errors.New("you are not allowed to ignore liveness")
+		} else if results, c.err = collectGarbage(c.ctx, c.db, options); c.err == nil {
+			c.debug("gc deleted:", len(results.paths), "freed:", results.bytesFreed)
+			c.err = c.nars.deleteUnused(c.ctx, results.narHashes)
+		}
+	}
+
+	c.writeStderrLast()
+	c.writeStrings(results.paths)
+	c.writeInt(results.bytesFreed)
+	c.writeInt(0) // obsolete
+}
+
 func (c *client) queryMissing() {
 	targets := c.readStrings()
 	c.debug("targets:", targets)
-	c.writeStderrLast()
 
 	willBuild := []string{}
 	willSubstitute := []string{}
 	unknown := []string{}
+	downloadSize, narSize := uint64(0), uint64(0)
+	substituting := map[string]bool{}
+
+	for _, target := range targets {
+		if c.err != nil {
+			break
+		}
 
-	unknown = append(willSubstitute, targets...)
+		// We never build, so outputs of derivations (drv!out) are unknown.
+		if strings.Contains(target, "!") {
+			unknown = append(unknown, target)
+			continue
+		}
+
+		missing, err := c.missingClosure(c.ctx, target)
+		if errors.Is(err, errNotInCache) {
+			unknown = append(unknown, target)
+			continue
+		} else if err != nil {
+			c.err = err
+			break
+		}
 
+		for _, storePath := range sortedKeys(missing) {
+			if !substituting[storePath] {
+				substituting[storePath] = true
+				willSubstitute = append(willSubstitute, storePath)
+				downloadSize += missing[storePath].narinfo.FileSize
+				narSize += missing[storePath].narinfo.NarSize
+			}
+		}
+	}
+
+	c.writeStderrLast()
 	c.writeStrings(willBuild)
 	c.writeStrings(willSubstitute)
 	c.writeStrings(unknown)
-	c.writeInt(100)
-	c.writeInt(100)
+	c.writeInt(downloadSize)
+	c.writeInt(narSize)
+}
+
+func (c *client) querySubstitutablePaths() {
+	paths := c.readStrings()
+	c.debug("querySubstitutablePaths:", paths)
+
+	substitutable := []string{}
+	if c.err == nil {
+		substitutable, c.err = c.substitutablePaths(c.ctx, paths)
+	}
+
+	c.writeStderrLast()
+	c.writeStrings(substitutable)
+}
+
+func (c *client) querySubstitutablePathInfos() {
+	paths := []string{}
+	if c.clientVersion&0xff < 22 {
+		paths = c.readStrings()
+	} else {
+		// StorePathCAMap; the content address is only a hint we don't need
+		for n := c.readInt(); n > 0 && c.err == nil; n-- {
+			paths = append(paths, c.readString(1024*4))
+			_ = c.readString(1024)
+		}
+	}
+	c.debug("querySubstitutablePathInfos:", paths)
+
+	subs := []*substitution{}
+	for _, storePath := range paths {
+		if c.err != nil {
+			break
+		}
+		if sub, err := c.querySubstitutable(c.ctx, storePath); err == nil {
+			subs = append(subs, sub)
+		} else if err != errNotInCache {
+			c.err = err
+		}
+	}
+
 	c.writeStderrLast()
+	c.writeInt(uint64(len(subs)))
+	for _, sub := range subs {
+		c.writeString(sub.info.OutPath)
+		c.writeString(sub.info.Deriver)
+		c.writeStrings(sub.info.References)
+		c.writeInt(sub.narinfo.FileSize)
+		c.writeInt(sub.narinfo.NarSize)
+	}
 }
 
 func (c *client) addMultipleToStore() {
@@ -192,7 +447,7 @@ func (c *client) addMultipleToStore() {
 	dontCheckSigs := c.readBool()
 	c.debug("repair:", repair, "dontCheckSigs:", dontCheckSigs)
 	narSource := newFramedSource(c.stdin)
-	if err := c.parseSource(narSource); err != nil {
+	if err := c.parseSource(narSource, dontCheckSigs); err != nil {
 		c.err = err
 	}
 	c.writeStderrLast()
@@ -201,13 +456,65 @@ func (c *client) addMultipleToStore() {
 	}
 }
 
+func (c *client) verifyStore() {
+	checkContents := c.readBool()
+	repair := c.readBool()
+	c.debug("verifyStore checkContents:", checkContents, "repair:", repair)
+
+	// Repairing replaces NARs every client shares, so like with nix-daemon
+	// only trusted users may do that.
+	damaged := false
+	if c.err == nil && repair && !c.identity.Trusted {
+		c.err = errors.New("you are not privileged to repair paths")
+	} else if c.err == nil {
+		damaged, c.err = c.verifyValidPaths(c.ctx, checkContents, repair)
+	}
+
+	c.writeStderrLast()
+	c.writeBool(damaged)
+}
+
+func (c *client) optimiseStore() {
+	c.debug("optimiseStore")
+
+	if c.err == nil {
+		c.err = c.optimiseNars(c.ctx)
+	}
+
+	c.writeStderrLast()
+	c.writeInt(1)
+}
+
+func (c *client) narFromPath() {
+	storePath := c.readString(1024 * 4)
+	c.debug("narFromPath:", storePath)
+
+	var nar io.ReadCloser
+	if c.err == nil {
+		if narHash, compression, err := c.nars.pathNar(c.ctx, storePath); err != nil {
+			c.err = err
+		} else {
+			nar, c.err = c.nars.open(c.ctx, narHash, compression)
+		}
+	}
+
+	c.writeStderrLast()
+	if c.err == nil {
+		defer nar.Close()
+		_, c.err = io.Copy(c.stdout, nar)
+	}
+}
+
 func (c *client) registerDrvOutput() {
 	realisation := c.readString(1024 * 10)
 	c.writeStderrLast()
 	c.debug("realisation:", realisation)
 }
 
-func (c *client) parseSource(s io.Reader) error {
+// parseSource stores the NARs of an AddMultipleToStore batch, and makes them
+// valid together once all were read, so the batch may come in any order but
+// has to be closed under references apart from paths that are valid already.
+func (c *client) parseSource(s io.Reader, dontCheckSigs bool) error {
 	expected, err := wire.ReadUint64(s)
 	if err != nil {
 		if err == io.EOF {
@@ -218,46 +525,66 @@ func (c *client) parseSource(s io.Reader) error {
 
 	c.debug("expected:", expected)
 
+	ctx := c.ctx
+	staged := map[string]*validPathInfo{}
+	registering := false
+	// Until the batch is registered, which cleans up after itself, a failure
+	// leaves the NARs staged so far unused.
+	defer func() {
+		if registering {
+			return
+		} else if err := c.nars.unstage(ctx, staged); err != nil {
+			c.debug("unstaging failed:", err)
+		}
+	}()
+
 	for i := uint64(0); i < expected; i += 1 {
-		if info, err := readNarinfo(s); err != nil {
+		info, err := readNarinfo(s)
+		if err != nil {
 			c.debug("err:", err.Error())
 			return errors.WithMessage(err, "reading Narinfo")
-		} else {
-			c.debug("narinfo:", info.OutPath)
-			swallow(s, int64(info.NarSize))
 		}
-	}
 
-	return nil
-}
-
-func swallow(s io.Reader, n int64) {
-	fd, err := os.Create("swallow")
-	if err != nil {
-		panic(err)
+		c.debug("narinfo:", info.OutPath)
+		if err := c.checkSignature(info, dontCheckSigs); err != nil {
+			return err
+		} else if err := c.session.addTempRoot(ctx, info.OutPath); err != nil {
+			return err
+		} else if ok, err := c.nars.stage(ctx, info, io.LimitReader(s, int64(info.NarSize)), c.writeStderrNext); err != nil {
+			return errors.WithMessagef(err, "adding %s", info.OutPath)
+		} else if ok {
+			staged[info.OutPath] = info
+		}
 	}
 
-	copied, err := io.Copy(fd, io.LimitReader(s, n))
+	registering = true
+	return c.nars.register(ctx, staged)
+}
 
-	if err != nil {
-		panic(err)
+// addToStore stores the NAR of info read from nar and makes the path valid.
+func (c *client) addToStore(ctx context.Context, info *validPathInfo, nar io.Reader) error {
+	if err := c.session.addTempRoot(ctx, info.OutPath); err != nil {
+		return err
 	}
 
-	if copied != n {
-		panic(fmt.Sprintf("copied %d of %d bytes", copied, n))
-	}
+	return c.nars.add(ctx, info, nar, c.writeStderrNext)
 }
 
 type validPathInfo struct {
-	OutPath          string `db:path`
-	Deriver          string `db:deriver`
-	NarHash          string `db:hash`
+	OutPath          string `db:"path"`
+	Deriver          string `db:"deriver"`
+	NarHash          string `db:"hash"`
 	References       []string
-	RegistrationTime time.Time `db:registration_rime`
-	NarSize          uint64    `db:nar_size`
-	Ultimate         bool      `db:ultimate`
-	Sigs             []string  `db:sigs`
-	CA               string    `db:ca`
+	RegistrationTime time.Time `db:"registration_time"`
+	NarSize          uint64    `db:"nar_size"`
+	Ultimate         bool      `db:"ultimate"`
+	Sigs             []string  `db:"sigs"`
+	CA               string    `db:"ca"`
+	FileHash         string    `db:"file_hash"`
+	FileSize         uint64    `db:"file_size"`
+	Compression      string    `db:"compression"`
+	// staged is the row in staged_nars while the NAR is staged.
+	staged int64
 }
 
 func readNarinfo(s io.Reader) (*validPathInfo, error) {
@@ -270,6 +597,8 @@ func readNarinfo(s io.Reader) (*validPathInfo, error) {
 		return nil, errors.WithMessage(err, "reading Deriver")
 	} else if info.NarHash, err = wire.ReadString(s, 1024); err != nil {
 		return nil, errors.WithMessage(err, "reading NarHash")
+	} else if info.NarHash, err = parseNarHash(info.NarHash); err != nil {
+		return nil, errors.WithMessage(err, "parsing NarHash")
 	} else if info.References, err = readStrings(s); err != nil {
 		return nil, errors.WithMessage(err, "reading References")
 	}
@@ -297,35 +626,6 @@ func readNarinfo(s io.Reader) (*validPathInfo, error) {
 	return info, nil
 }
 
-func readNar(s io.Reader) error {
-	n, err := nar.NewReader(s)
-	if err != nil {
-		return err
-	}
-	for {
-		header, err := n.Next()
-		pp(header, err)
-
-		if err != nil {
-			if err.Error() == "unexpected EOF" {
-				return nil
-			}
-			return errors.WithMessage(err, "getting NAR header")
-		}
-
-		switch header.Type {
-		case nar.TypeSymlink:
-			pp("sym", header.Path, header.LinkTarget)
-		case nar.TypeDirectory:
-			pp("dir", header.Path)
-		case nar.TypeRegular:
-			pp("reg", header.Path, header.Size, header.Executable)
-			// buf := bytes.Buffer{}
-			// pp(io.Copy(&buf, n))
-		}
-	}
-}
-
 func (c *client) readString(max uint64) (out string) {
 	if c.err == nil {
 		out, c.err = wire.ReadString(c.stdin, max)
@@ -370,10 +670,44 @@ func (c *client) writeInt(value uint64) {
 	}
 }
 
+func (c *client) writeString(value string) {
+	if c.err == nil {
+		c.err = wire.WriteString(c.stdout, value)
+	}
+}
+
 func (c *client) writeStderrLast() {
+	if c.err == nil {
+		c.workDone = true
+	}
 	c.writeInt(StderrLast)
 }
 
+// writeStderrError reports err to the client instead of the result of the
+// current operation, unless that was started already.
+func (c *client) writeStderrError(err error) {
+	if c.workDone {
+		return
+	}
+
+	var werr error
+	if c.clientVersion&0xff >= 26 {
+		werr = writeFields(c.stdout, uint64(StderrError), "Error", uint64(0), "Error", err.Error(), uint64(0), uint64(0))
+	} else {
+		werr = writeFields(c.stdout, uint64(StderrError), err.Error(), uint64(1))
+	}
+	if werr != nil {
+		c.debug("writing error:", werr.Error())
+	}
+}
+
+// writeStderrNext sends a log message to the client while an operation is in
+// progress.
+func (c *client) writeStderrNext(msg string) {
+	c.writeInt(StderrNext)
+	c.writeString(msg + "\n")
+}
+
 func (c *client) writeStrings(value []string) {
 	if c.err == nil {
 		c.err = writeStrings(c.stdout, value)
@@ -405,6 +739,23 @@ func readStrings(s io.Reader) ([]string, error) {
 	return output, nil
 }
 
+// writeFields writes strings and integers in the wire format.
+func writeFields(s io.Writer, fields ...any) error {
+	for _, field := range fields {
+		var err error
+		switch field := field.(type) {
+		case string:
+			err = wire.WriteString(s, field)
+		case uint64:
+			err = wire.WriteUint64(s, field)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func writeStrings(s io.Writer, strings []string) error {
 	if err := wire.WriteUint64(s, uint64(len(strings))); err != nil {
 		return err
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	xssh "golang.org/x/crypto/ssh"
+)
+
+// authorizedKeysPollInterval is how often the file is checked for changes.
+const authorizedKeysPollInterval = 5 * time.Second
+
+// fileKeys allows the keys of an authorized_keys file, for users without a
+// GitHub account like build bots. The file is reloaded when it changes.
+type fileKeys struct {
+	keySet
+	path    string
+	log     *zap.Logger
+	modTime time.Time
+	size    int64
+}
+
+// loadFileKeys reads the keys of path, and keeps reloading them in the
+// background when the file changes. If a reload fails, the last keys are
+// kept.
+func loadFileKeys(path string, log *zap.Logger) (*fileKeys, error) {
+	f := &fileKeys{path: path, log: log}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			time.Sleep(authorizedKeysPollInterval)
+			if reloaded, err := f.reload(); err != nil {
+				f.log.Error("while reloading authorized keys, keeping the last keys", zap.Error(err), zap.String("path", f.path))
+			} else if reloaded {
+				f.log.Info("reloaded authorized keys", zap.String("path", f.path), zap.Int("keys", f.count()))
+			}
+		}
+	}()
+
+	return f, nil
+}
+
+// reload reads the file if it changed since the last time, and returns
+// whether it did.
+func (f *fileKeys) reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, errors.WithMessage(err, "while checking authorized keys")
+	} else if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return false, nil
+	}
+
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, errors.WithMessage(err, "while reading authorized keys")
+	}
+
+	keys, err := parseAuthorizedKeys(content)
+	if err != nil {
+		return false, err
+	}
+
+	f.replace(f.log, keys)
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return true, nil
+}
+
+// parseAuthorizedKeys reads lines in the format of authorized_keys. The
+// principal of a key is given with the principal="name" option, or else is
+// its comment. Principals are kept apart from GitHub logins. Any number of
+// role="role" options give it roles. Other options are ignored.
+func parseAuthorizedKeys(content []byte) (map[string]memberWithKey, error) {
+	keys := map[string]memberWithKey{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		publicKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(text))
+		if err != nil {
+			return nil, errors.Errorf("authorized keys line %d: %s", line, err)
+		}
+
+		mwk := memberWithKey{principal: comment, key: publicKey}
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			value = strings.Trim(value, `"`)
+			switch name {
+			case "principal":
+				mwk.principal = value
+			case "role":
+				if !contains(mwk.roles, value) {
+					mwk.roles = append(mwk.roles, value)
+				}
+			}
+		}
+		if mwk.principal == "" {
+			return nil, errors.Errorf("authorized keys line %d: key needs a principal option or a comment", line)
+		}
+
+		keyHash := xssh.FingerprintSHA256(publicKey)
+		if _, seen := keys[keyHash]; !seen {
+			keys[keyHash] = mwk
+		}
+	}
+
+	return keys, errors.WithMessage(scanner.Err(), "while reading authorized keys")
+}
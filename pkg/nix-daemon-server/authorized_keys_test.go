@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"go.uber.org/zap"
+	xssh "golang.org/x/crypto/ssh"
+)
+
+// testKey returns a key made from seed and its authorized_keys line.
+func testKey(t *testing.T, seed byte) (ssh.PublicKey, string) {
+	t.Helper()
+	private := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	key, err := xssh.NewPublicKey(private.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, strings.TrimSpace(string(xssh.MarshalAuthorizedKey(key)))
+}
+
+// describe is what tests compare members by.
+func describe(mwk memberWithKey) string {
+	return mwk.name() + " " + strings.Join(mwk.roles, ",")
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	key1, line1 := testKey(t, 1)
+	key2, line2 := testKey(t, 2)
+	fp1, fp2 := xssh.FingerprintSHA256(key1), xssh.FingerprintSHA256(key2)
+
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{name: "empty", content: "\n# nothing here\n", want: map[string]string{}},
+		{name: "principal from comment", content: line1 + " buildkite\n", want: map[string]string{fp1: "key:buildkite "}},
+		{
+			name:    "principal and roles from options",
+			content: `principal="hydra",role="uploader",no-pty,role="builder",role="uploader" ` + line1 + " hydra@ci\n",
+			want:    map[string]string{fp1: "key:hydra uploader,builder"},
+		},
+		{
+			name:    "first line of a key wins",
+			content: line1 + " first\n" + line2 + " other\n" + line1 + " second\n",
+			want:    map[string]string{fp1: "key:first ", fp2: "key:other "},
+		},
+		{name: "no principal", content: line1 + "\n"},
+		{name: "invalid key", content: line1 + " ok\nssh-ed25519 AAAA broken\n"},
+	}
+
+	for _, test := range tests {
+		got, err := parseAuthorizedKeys([]byte(test.content))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", test.name, got)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %d keys, want %d", test.name, len(got), len(test.want))
+		}
+		for fingerprint, want := range test.want {
+			if mwk := got[fingerprint]; mwk.key == nil || xssh.FingerprintSHA256(mwk.key) != fingerprint || describe(mwk) != want {
+				t.Errorf("%s: got %q, want %q", test.name, describe(mwk), want)
+			}
+		}
+	}
+}
+
+func TestKeySetReplace(t *testing.T) {
+	key1, _ := testKey(t, 1)
+	key2, _ := testKey(t, 2)
+	alice := memberWithKey{login: "alice", key: key1}
+	bob := memberWithKey{login: "bob", key: key2}
+	aliceUploader := memberWithKey{login: "alice", key: key1, roles: []string{"uploader"}}
+
+	set := &keySet{}
+	for _, step := range [][]memberWithKey{{alice}, {bob}, {aliceUploader, bob}, {}} {
+		keys := map[string]memberWithKey{}
+		for _, mwk := range step {
+			keys[xssh.FingerprintSHA256(mwk.key)] = mwk
+		}
+		set.replace(zap.NewNop(), keys)
+
+		if set.count() != len(step) {
+			t.Errorf("got %d keys, want %d", set.count(), len(step))
+		}
+		for _, key := range []ssh.PublicKey{key1, key2} {
+			want, allowed := keys[xssh.FingerprintSHA256(key)]
+			if got, ok := set.lookup(key); ok != allowed || describe(got) != describe(want) {
+				t.Errorf("lookup after replacing with %v: got %q, want %q", step, describe(got), describe(want))
+			}
+		}
+	}
+}
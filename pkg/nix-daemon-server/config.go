@@ -5,21 +5,44 @@ import (
 	"strings"
 	"time"
 
-	"go.uber.org/zap"
+	"github.com/pkg/errors"
 )
 
 type config struct {
-	HostKeyPath string        `arg:"--host-key,env:HOST_KEY" help:"SSH server host key"`
-	ListenAddr  string        `arg:"--listen,env:LISTEN_ADDR" help:"Listen on this address:port"`
-	LogLevel    string        `arg:"--log-level,env:LOG_LEVEL" help:"one of debug, info, warn, error, dpanic, panic, fatal"`
-	LogMode     string        `arg:"--log-mode,env:LOG_MODE" help:"development or production"`
-	MaxSessions int64         `arg:"--max-sessions,env:MAX_SESSIONS" help:"maximum amount of concurrent sessions"`
-	NewConnTime time.Duration `arg:"--new-connection-timeout,env:CONNECTION_TIMEOUT" help:"how long new connections may be delayed before a session becomes available"`
-	GHSyncTime  time.Duration `arg:"--github-refresh-interval,env:GITHUB_REFRESH_INTERVAL" help:"synchronize allowed keys from Github every interval"`
-	GHOrg       string        `arg:"--github-organization,required,env:GITHUB_ORGANIZATION" help:"organization the team is in"`
-	GHTeam      string        `arg:"--github-team,required,env:GITHUB_TEAM" help:"fetch keys of the members of this team"`
-	GHToken     string        `arg:"--github-token,env:GITHUB_TOKEN" help:"github token; takes precedence over the token path"`
-	GHTokenPath string        `arg:"--github-token-path,env:GITHUB_TOKEN_PATH" help:"read github token from a file instead"`
+	HostKeyPath    string        `arg:"--host-key,env:HOST_KEY" help:"SSH server host key"`
+	ListenAddr     string        `arg:"--listen,env:LISTEN_ADDR" help:"Listen on this address:port"`
+	LogLevel       string        `arg:"--log-level,env:LOG_LEVEL" help:"one of debug, info, warn, error, dpanic, panic, fatal"`
+	LogMode        string        `arg:"--log-mode,env:LOG_MODE" help:"development or production"`
+	MaxSessions    int64         `arg:"--max-sessions,env:MAX_SESSIONS" help:"maximum amount of concurrent sessions"`
+	NewConnTime    time.Duration `arg:"--new-connection-timeout,env:CONNECTION_TIMEOUT" help:"how long new connections may be delayed before a session becomes available"`
+	GHSyncTime     time.Duration `arg:"--github-refresh-interval,env:GITHUB_REFRESH_INTERVAL" help:"synchronize allowed keys from Github every interval"`
+	GHOrg          string        `arg:"--github-organization,env:GITHUB_ORGANIZATION" help:"organization of teams given without one"`
+	GHTeams        []string      `arg:"--github-team,separate,required,env:GITHUB_TEAM" help:"fetch keys of the members of this [organization/]team[=role]"`
+	GHMaxStaleness time.Duration `arg:"--github-max-staleness,env:GITHUB_MAX_STALENESS" help:"refuse logins if keys couldn't be synced for this long; 0 to never refuse"`
+	GHKeysCache    string        `arg:"--github-keys-cache,env:GITHUB_KEYS_CACHE" help:"keep the synced keys in this file, to use them if GitHub is unavailable on startup"`
+	GHToken        string        `arg:"--github-token,env:GITHUB_TOKEN" help:"github token; takes precedence over the token path"`
+	GHTokenPath    string        `arg:"--github-token-path,env:GITHUB_TOKEN_PATH" help:"read github token from a file instead"`
+
+	DatabaseURL       string `arg:"--database-url,env:DATABASE_URL" help:"Postgres database of the store"`
+	BlobStore         string `arg:"--blob-store,env:BLOB_STORE" help:"local path or s3:// URL to keep NARs in"`
+	NarCompression    string `arg:"--nar-compression,env:NAR_COMPRESSION" help:"compress NARs at rest with none, zstd or xz"`
+	ReferenceCheck    string `arg:"--reference-check,env:REFERENCE_CHECK" help:"reject or warn about NARs mentioning valid paths they don't declare"`
+	Substituters      string `arg:"--substituters,env:SUBSTITUTERS" help:"space separated binary caches to fetch missing paths from"`
+	TrustedPublicKeys string `arg:"--trusted-public-keys,env:TRUSTED_PUBLIC_KEYS" help:"space separated keys substituted and uploaded paths must be signed with"`
+
+	AuthorizedKeysPath string `arg:"--authorized-keys-file,env:AUTHORIZED_KEYS_FILE" help:"also allow the keys in this authorized_keys file, reloaded when it changes"`
+
+	PolicyFile string `arg:"--policy-file,env:POLICY_FILE" help:"which users and teams may use which worker operations"`
+
+	MetricsListenAddr string `arg:"--metrics-listen,env:METRICS_LISTEN_ADDR" help:"serve expvar metrics and a health check on this address:port"`
+
+	HTTPListenAddr string `arg:"--http-listen,env:HTTP_LISTEN_ADDR" help:"also serve the store as an HTTP binary cache on this address:port"`
+	SecretKeyPath  string `arg:"--secret-key-file,env:SECRET_KEY_FILE" help:"sign narinfos served over HTTP with this nix secret key"`
+	UploadersPath  string `arg:"--upload-credentials-file,env:UPLOAD_CREDENTIALS_FILE" help:"login:token lines allowed to upload to the HTTP binary cache"`
+	TLSCertPath    string `arg:"--http-tls-cert-file,env:HTTP_TLS_CERT_FILE" help:"serve the HTTP binary cache over HTTPS with this certificate"`
+	TLSKeyPath     string `arg:"--http-tls-key-file,env:HTTP_TLS_KEY_FILE" help:"private key of the HTTPS certificate"`
+
+	TrustedUsers []string `arg:"--trusted-user,separate,env:TRUSTED_USERS" help:"Github users, @organization/team or key:<principal> that may add unsigned paths and change restricted settings"`
 }
 
 func newConfig() *config {
@@ -31,7 +54,54 @@ func newConfig() *config {
 		MaxSessions: 2,
 		NewConnTime: 1 * time.Second,
 		GHSyncTime:  1 * time.Minute,
+		BlobStore:   "nars",
+	}
+}
+
+// githubTeam is a team whose members may log in, and the role they get.
+type githubTeam struct {
+	org  string
+	team string
+	role string
+}
+
+func (t githubTeam) String() string {
+	return t.org + "/" + t.team
+}
+
+// teams parses the --github-team options.
+func (c config) teams() ([]githubTeam, error) {
+	teams := []githubTeam{}
+	for _, spec := range c.GHTeams {
+		t := githubTeam{org: c.GHOrg}
+		spec, t.role, _ = strings.Cut(spec, "=")
+		if org, team, ok := strings.Cut(spec, "/"); ok {
+			t.org, t.team = org, team
+		} else {
+			t.team = spec
+		}
+		if t.org == "" || t.team == "" {
+			return nil, errors.Errorf("invalid github team '%s': expected organization/team[=role]", spec)
+		}
+		teams = append(teams, t)
 	}
+	return teams, nil
+}
+
+// trusted is whether member is one of the trusted users, by GitHub login,
+// team or key:<principal>.
+func (c config) trusted(member memberWithKey) bool {
+	for _, user := range c.TrustedUsers {
+		if user == member.name() {
+			return true
+		}
+		for _, team := range member.teams {
+			if user == "@"+team {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 var (
@@ -43,26 +113,20 @@ func (config) Version() string {
 	return buildVersion + " (" + buildCommit + ")"
 }
 
-// TODO: depending on the token rotation strategy, this may be subject to race
-// conditions when the token file is not replaced atomically.
-// We could work around it with caching, but that will cause a lot more
-// complexity so we just assume responsible usage and crash when the file is
-// unreadable or incomplete.
-func (c config) Token(log *zap.Logger) string {
+// Token reads the github token from the flag or from the token file, which
+// is read again on every call so it can be rotated. If the file isn't
+// replaced atomically, a read may fail or be incomplete; syncs count that as
+// failure and retry.
+func (c config) Token() (string, error) {
 	if c.GHToken != "" {
-		return strings.TrimSpace(c.GHToken)
+		return strings.TrimSpace(c.GHToken), nil
+	} else if c.GHTokenPath == "" {
+		return "", errors.New("--github-token or --github-token-path is required (alternatively environment variables GITHUB_TOKEN or GITHUB_TOKEN_PATH)")
 	}
 
-	if c.GHTokenPath != "" {
-		token, err := os.ReadFile(c.GHTokenPath)
-		if err != nil {
-			log.Fatal("couldn't read token", zap.Error(err), zap.String("path", c.GHTokenPath))
-		}
-		return strings.TrimSpace(string(token))
-	} else {
-		println("error: --github-token or --github-token-path is required (alternatively environment variables GITHUB_TOKEN or GITHUB_TOKEN_PATH)")
-		os.Exit(1)
+	token, err := os.ReadFile(c.GHTokenPath)
+	if err != nil {
+		return "", errors.WithMessage(err, "while reading github token")
 	}
-
-	panic("unreachable")
+	return strings.TrimSpace(string(token)), nil
 }
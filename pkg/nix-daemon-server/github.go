@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/shurcooL/githubv4"
+)
+
+// pageSize is the most GitHub returns per connection and request.
+const pageSize = 100
+
+type pageInfo struct {
+	HasNextPage githubv4.Boolean
+	EndCursor   githubv4.String
+}
+
+type publicKeys struct {
+	Nodes []struct {
+		Key githubv4.String
+	}
+	PageInfo pageInfo
+}
+
+type teamMembersQuery struct {
+	Organization struct {
+		Team *struct {
+			Members struct {
+				Nodes []struct {
+					Login      githubv4.String
+					PublicKeys publicKeys `graphql:"publicKeys(first:$pageSize)"`
+				}
+				PageInfo pageInfo
+			} `graphql:"members(first:$pageSize, after:$membersCursor)"`
+		} `graphql:"team(slug:$team)"`
+	} `graphql:"organization(login:$org)"`
+}
+
+type userKeysQuery struct {
+	User struct {
+		PublicKeys publicKeys `graphql:"publicKeys(first:$pageSize, after:$keysCursor)"`
+	} `graphql:"user(login:$login)"`
+}
+
+// fetchTeamKeys returns the public keys of all members of the team, by login.
+// Members come a page at a time, and the keys of members with more than fit
+// on the first page are fetched for each of them.
+func fetchTeamKeys(ctx context.Context, client *githubv4.Client, org, team string) (map[string][]string, error) {
+	members := map[string][]string{}
+	variables := map[string]any{
+		"org":           githubv4.String(org),
+		"team":          githubv4.String(team),
+		"pageSize":      githubv4.Int(pageSize),
+		"membersCursor": (*githubv4.String)(nil),
+	}
+
+	for {
+		query := teamMembersQuery{}
+		if err := client.Query(ctx, &query, variables); err != nil {
+			return nil, errors.WithMessagef(err, "while querying members of %s/%s", org, team)
+		} else if query.Organization.Team == nil {
+			return nil, errors.Errorf("team %s/%s not found", org, team)
+		}
+
+		teamMembers := query.Organization.Team.Members
+		for _, member := range teamMembers.Nodes {
+			login := string(member.Login)
+			keys := member.PublicKeys.keys()
+			if member.PublicKeys.PageInfo.HasNextPage {
+				more, err := fetchUserKeys(ctx, client, login, member.PublicKeys.PageInfo.EndCursor)
+				if err != nil {
+					return nil, err
+				}
+				keys = append(keys, more...)
+			}
+			members[login] = keys
+		}
+
+		if !teamMembers.PageInfo.HasNextPage {
+			return members, nil
+		}
+		variables["membersCursor"] = githubv4.NewString(teamMembers.PageInfo.EndCursor)
+	}
+}
+
+// fetchUserKeys returns the public keys of login after cursor.
+func fetchUserKeys(ctx context.Context, client *githubv4.Client, login string, cursor githubv4.String) ([]string, error) {
+	keys := []string{}
+	variables := map[string]any{
+		"login":      githubv4.String(login),
+		"pageSize":   githubv4.Int(pageSize),
+		"keysCursor": githubv4.NewString(cursor),
+	}
+
+	for {
+		query := userKeysQuery{}
+		if err := client.Query(ctx, &query, variables); err != nil {
+			return nil, errors.WithMessagef(err, "while querying keys of %s", login)
+		}
+
+		keys = append(keys, query.User.PublicKeys.keys()...)
+		if !query.User.PublicKeys.PageInfo.HasNextPage {
+			return keys, nil
+		}
+		variables["keysCursor"] = githubv4.NewString(query.User.PublicKeys.PageInfo.EndCursor)
+	}
+}
+
+func (k publicKeys) keys() []string {
+	keys := make([]string, 0, len(k.Nodes))
+	for _, node := range k.Nodes {
+		keys = append(keys, string(node.Key))
+	}
+	return keys
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
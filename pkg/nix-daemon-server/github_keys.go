@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/shurcooL/githubv4"
+	"go.uber.org/zap"
+	xssh "golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2"
+)
+
+// githubKeys allows the keys of the members of the configured teams.
+type githubKeys struct {
+	keySet
+	config  *config
+	log     *zap.Logger
+	teams   []githubTeam
+	keySync keySync
+}
+
+// lookup refuses all keys once they are too stale.
+func (g *githubKeys) lookup(key ssh.PublicKey) (memberWithKey, bool) {
+	mwk, ok := g.keySet.lookup(key)
+	if ok && g.tooStale() {
+		g.log.Warn("login refused, keys are stale", zap.String("key", xssh.FingerprintSHA256(key)), zap.Duration("staleness", g.keySync.staleness()))
+		return memberWithKey{}, false
+	}
+	return mwk, ok
+}
+
+// tooStale is whether logins have to be refused, because the keys weren't
+// synced within the configured max staleness.
+func (g *githubKeys) tooStale() bool {
+	staleness := g.keySync.staleness()
+	return staleness < 0 || (g.config.GHMaxStaleness > 0 && staleness > g.config.GHMaxStaleness)
+}
+
+// start fetches the keys once and then keeps syncing them in the background.
+// If that fails, the keys of the last successful sync are kept and it's
+// retried with backoff. If the first sync fails, the keys are loaded from the
+// cache, if there is one.
+func (g *githubKeys) start() {
+	if err := g.sync(); err == nil {
+		g.keySync.succeeded()
+	} else if g.config.GHKeysCache == "" {
+		g.log.Fatal("initially syncing github", zap.Error(err))
+	} else if cache, cacheErr := loadKeysCache(g.config.GHKeysCache); cacheErr != nil {
+		g.log.Fatal("initially syncing github", zap.Error(err), zap.NamedError("cache error", cacheErr))
+	} else {
+		g.store(cache.Members)
+		g.keySync.loadedCache(cache.SyncedAt)
+		g.log.Error("initially syncing github failed, using cached keys",
+			zap.Error(err),
+			zap.Time("synced at", cache.SyncedAt),
+			zap.Int("members", len(cache.Members)),
+		)
+	}
+
+	go func() {
+		delay := g.config.GHSyncTime
+		if g.keySync.failures.Load() > 0 {
+			delay = retryDelay(g.keySync.failures.Load())
+		}
+		for {
+			time.Sleep(delay)
+			if err := g.sync(); err != nil {
+				failures := g.keySync.failed()
+				delay = retryDelay(failures)
+				g.log.Error("while syncing github, keeping the last keys",
+					zap.Error(err),
+					zap.Int64("failures", failures),
+					zap.Duration("retry in", delay),
+					zap.Duration("staleness", g.keySync.staleness()),
+				)
+			} else {
+				g.keySync.succeeded()
+				delay = g.config.GHSyncTime
+			}
+		}
+	}()
+}
+
+// sync replaces the keys with the ones of the members of all teams, and
+// caches them if configured to.
+func (g *githubKeys) sync() error {
+	g.log.Debug("fetching github keys")
+	token, err := g.config.Token()
+	if err != nil {
+		return err
+	}
+	src := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: token},
+	)
+	httpClient := oauth2.NewClient(context.Background(), src)
+	client := githubv4.NewClient(httpClient)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Members of several teams get all their teams and roles.
+	members := map[string]*githubMember{}
+	for _, team := range g.teams {
+		teamKeys, err := fetchTeamKeys(ctx, client, team.org, team.team)
+		if err != nil {
+			return err
+		}
+		for login, loginKeys := range teamKeys {
+			member, ok := members[login]
+			if !ok {
+				member = &githubMember{Login: login}
+				members[login] = member
+			}
+			member.Teams = append(member.Teams, team.String())
+			if team.role != "" && !contains(member.Roles, team.role) {
+				member.Roles = append(member.Roles, team.role)
+			}
+			member.Keys = append(member.Keys, loginKeys...)
+		}
+	}
+
+	list := make([]*githubMember, 0, len(members))
+	for _, login := range sortedKeys(members) {
+		list = append(list, members[login])
+	}
+
+	g.store(list)
+
+	if g.config.GHKeysCache != "" {
+		if err := saveKeysCache(g.config.GHKeysCache, keysCache{SyncedAt: time.Now(), Members: list}); err != nil {
+			g.log.Error("while caching github keys", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// store makes the set hold exactly the keys of members.
+func (g *githubKeys) store(members []*githubMember) {
+	keys := map[string]memberWithKey{}
+
+	for _, member := range members {
+		for _, key := range member.Keys {
+			publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+			if err != nil {
+				g.log.Error("while parsing key", zap.Error(err), zap.String("login", member.Login))
+				continue
+			}
+			keyHash := xssh.FingerprintSHA256(publicKey)
+			if _, seen := keys[keyHash]; seen {
+				continue
+			}
+			keys[keyHash] = memberWithKey{login: member.Login, key: publicKey, teams: member.Teams, roles: member.Roles}
+		}
+	}
+
+	g.replace(g.log, keys)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// keySync tracks how up to date the allowed keys are, so the server can keep
+// going with the last keys it got while GitHub is unavailable.
+type keySync struct {
+	lastSuccess atomic.Int64 // unix nanoseconds
+	failures    atomic.Int64 // since the last success
+}
+
+func (k *keySync) succeeded() {
+	k.lastSuccess.Store(time.Now().UnixNano())
+	k.failures.Store(0)
+}
+
+// loadedCache records that the keys come from the cache of a sync at t,
+// because the sync failed.
+func (k *keySync) loadedCache(t time.Time) {
+	k.lastSuccess.Store(t.UnixNano())
+	k.failures.Store(1)
+}
+
+// failed counts a failed sync and returns how many failed in a row.
+func (k *keySync) failed() int64 {
+	return k.failures.Add(1)
+}
+
+// staleness is the time since the last successful sync, or -1 if there
+// was none.
+func (k *keySync) staleness() time.Duration {
+	last := k.lastSuccess.Load()
+	if last == 0 {
+		return -1
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// retryDelay backs off exponentially from a few seconds to maxRetryDelay.
+func retryDelay(failures int64) time.Duration {
+	const minRetryDelay, maxRetryDelay = 5 * time.Second, 10 * time.Minute
+	delay := minRetryDelay
+	for i := int64(1); i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// publishMetrics exposes the state of the key sync and the number of
+// allowed keys with expvar.
+func (p *proxy) publishMetrics() {
+	expvar.Publish("github_keys_staleness_seconds", expvar.Func(func() any {
+		return p.github.keySync.staleness().Seconds()
+	}))
+	expvar.Publish("github_keys_sync_failures", expvar.Func(func() any {
+		return p.github.keySync.failures.Load()
+	}))
+	expvar.Publish("github_keys", expvar.Func(func() any {
+		return p.github.count()
+	}))
+	expvar.Publish("allowed_keys", expvar.Func(func() any {
+		count := 0
+		for _, source := range p.sources {
+			count += source.count()
+		}
+		return count
+	}))
+}
+
+// serveMetrics serves expvar at /debug/vars and the health of the server at
+// /health, which fails once logins with GitHub keys are refused for being
+// stale.
+func (p *proxy) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if p.github.tooStale() {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status":              http.StatusText(status),
+			"stalenessSeconds":    p.github.keySync.staleness().Seconds(),
+			"syncFailures":        p.github.keySync.failures.Load(),
+			"maxStalenessSeconds": p.config.GHMaxStaleness.Seconds(),
+		})
+	})
+
+	go func() {
+		err := http.ListenAndServe(p.config.MetricsListenAddr, mux)
+		p.log.Fatal("metrics server exited", zap.Error(err))
+	}()
+}
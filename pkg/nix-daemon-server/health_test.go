@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int64
+		want     time.Duration
+	}{
+		{failures: 0, want: 5 * time.Second},
+		{failures: 1, want: 5 * time.Second},
+		{failures: 2, want: 10 * time.Second},
+		{failures: 3, want: 20 * time.Second},
+		{failures: 7, want: 320 * time.Second},
+		{failures: 8, want: 10 * time.Minute},
+		{failures: 1000, want: 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := retryDelay(test.failures); got != test.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", test.failures, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	protocol "github.com/input-output-hk/nix-daemon-server/pkg/nix-daemon-protocol"
+	"go.uber.org/zap"
+)
+
+// serveHTTPCache runs the binary cache frontend next to the SSH server. It
+// shares the database and blob store with the sessions, so there is nothing
+// to keep in sync. The server stops if the frontend does.
+func (p *proxy) serveHTTPCache() {
+	go func() {
+		err := p.server.ServeHTTPCache(protocol.HTTPCacheConfig{
+			ListenAddr:      p.config.HTTPListenAddr,
+			SecretKeyFile:   p.config.SecretKeyPath,
+			CredentialsFile: p.config.UploadersPath,
+			TLSCertFile:     p.config.TLSCertPath,
+			TLSKeyFile:      p.config.TLSKeyPath,
+		})
+		p.log.Fatal("http cache exited", zap.Error(err))
+	}()
+}
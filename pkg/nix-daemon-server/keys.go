@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"go.uber.org/zap"
+	xssh "golang.org/x/crypto/ssh"
+)
+
+// keySource is somewhere the keys allowed to log in come from. Each source
+// keeps its keys up to date by itself.
+type keySource interface {
+	// lookup finds the member key belongs to, if it may log in.
+	lookup(key ssh.PublicKey) (memberWithKey, bool)
+	// count is how many keys are allowed.
+	count() int
+}
+
+// keySet holds the allowed keys of a source by their SHA256 fingerprint.
+type keySet struct {
+	keys sync.Map
+}
+
+func (s *keySet) lookup(key ssh.PublicKey) (memberWithKey, bool) {
+	mk, ok := s.keys.Load(xssh.FingerprintSHA256(key))
+	if !ok {
+		return memberWithKey{}, false
+	}
+	mwk := mk.(memberWithKey)
+	return mwk, ssh.KeysEqual(key, mwk.key)
+}
+
+func (s *keySet) count() int {
+	count := 0
+	s.keys.Range(func(_, _ any) bool { count++; return true })
+	return count
+}
+
+// replace makes the set hold exactly keys, which are by fingerprint.
+func (s *keySet) replace(log *zap.Logger, keys map[string]memberWithKey) {
+	for keyHash, mwk := range keys {
+		if _, loaded := s.keys.Load(keyHash); !loaded {
+			log.Debug("stored new key", zap.String("key", keyHash), zap.String("login", mwk.name()), zap.Strings("teams", mwk.teams))
+		}
+		s.keys.Store(keyHash, mwk)
+	}
+
+	s.keys.Range(func(key, value any) bool {
+		if _, ok := keys[key.(string)]; !ok {
+			s.keys.Delete(key)
+			log.Debug("deleted old key", zap.String("key", key.(string)), zap.String("login", value.(memberWithKey).name()))
+		}
+		return true
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// githubMember is a member of one or more of the teams, with their keys in
+// authorized_keys format.
+type githubMember struct {
+	Login string   `json:"login"`
+	Teams []string `json:"teams"`
+	Roles []string `json:"roles,omitempty"`
+	Keys  []string `json:"keys"`
+}
+
+// keysCache is what the last successful sync got from GitHub, so a restart
+// while GitHub is unavailable can still let members in.
+type keysCache struct {
+	SyncedAt time.Time       `json:"syncedAt"`
+	Members  []*githubMember `json:"members"`
+}
+
+func loadKeysCache(path string) (*keysCache, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while reading keys cache")
+	}
+
+	cache := &keysCache{}
+	if err := json.Unmarshal(content, cache); err != nil {
+		return nil, errors.WithMessage(err, "while parsing keys cache")
+	}
+	return cache, nil
+}
+
+// saveKeysCache replaces the cache at path atomically, so a crash while
+// writing can't leave a broken one behind.
+func saveKeysCache(path string, cache keysCache) error {
+	content, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.WithMessage(err, "while creating keys cache")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.WithMessage(err, "while writing keys cache")
+	} else if err := tmp.Close(); err != nil {
+		return errors.WithMessage(err, "while writing keys cache")
+	}
+
+	return errors.WithMessage(os.Rename(tmp.Name(), path), "while replacing keys cache")
+}
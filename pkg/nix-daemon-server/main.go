@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+
 	"github.com/alexflint/go-arg"
 	"github.com/gliderlabs/ssh"
+	protocol "github.com/input-output-hk/nix-daemon-server/pkg/nix-daemon-protocol"
 	"go.uber.org/zap"
 )
 
@@ -12,7 +15,43 @@ func main() {
 
 	p := proxy{config: c, sessions: make(chan bool, c.MaxSessions)}
 	p.setupLog()
-	p.allowedKeys = p.syncAllowedKeys()
+
+	teams, err := c.teams()
+	if err != nil {
+		p.log.Fatal("Invalid configuration", zap.Error(err))
+	} else if _, err := c.Token(); err != nil {
+		p.log.Fatal("Invalid configuration", zap.Error(err))
+	}
+	p.github = &githubKeys{config: c, log: p.log, teams: teams}
+	p.github.start()
+	p.sources = []keySource{p.github}
+
+	if c.AuthorizedKeysPath != "" {
+		fileKeys, err := loadFileKeys(c.AuthorizedKeysPath, p.log)
+		if err != nil {
+			p.log.Fatal("Failed to load authorized keys", zap.Error(err))
+		}
+		p.sources = append(p.sources, fileKeys)
+	}
+
+	server, err := protocol.Open(context.Background(), protocol.Config{
+		DatabaseURL: c.DatabaseURL,
+		// Every session holds a connection for its temporary roots and
+		// needs a second one for operations like registering paths. The
+		// rest is left for the HTTP cache and background work.
+		MaxConns:          2*int32(c.MaxSessions) + 4,
+		BlobStore:         c.BlobStore,
+		NarCompression:    c.NarCompression,
+		ReferenceCheck:    c.ReferenceCheck,
+		Substituters:      c.Substituters,
+		TrustedPublicKeys: c.TrustedPublicKeys,
+		PolicyFile:        c.PolicyFile,
+	})
+	if err != nil {
+		p.log.Fatal("Failed to open store", zap.Error(err))
+	}
+	defer server.Close()
+	p.server = server
 
 	p.log.Info("Starting server",
 		zap.String("address", c.ListenAddr),
@@ -22,11 +61,32 @@ func main() {
 		zap.Int64("max session", c.MaxSessions),
 		zap.Duration("new connection timeout", c.NewConnTime),
 		zap.Duration("github sync timer", c.GHSyncTime),
-		zap.String("github team", c.GHTeam),
-		zap.String("github organization", c.GHOrg),
+		zap.Duration("github max staleness", c.GHMaxStaleness),
+		zap.String("github keys cache", c.GHKeysCache),
+		zap.String("metrics address", c.MetricsListenAddr),
+		zap.Strings("github teams", c.GHTeams),
 		zap.String("github token path", c.GHTokenPath),
+		zap.String("authorized keys file", c.AuthorizedKeysPath),
+		zap.Strings("trusted users", c.TrustedUsers),
+		zap.String("blob store", c.BlobStore),
+		zap.String("nar compression", c.NarCompression),
+		zap.String("substituters", c.Substituters),
+		zap.String("policy file", c.PolicyFile),
+		zap.String("http address", c.HTTPListenAddr),
+		zap.String("secret key file", c.SecretKeyPath),
+		zap.String("upload credentials file", c.UploadersPath),
+		zap.String("http tls certificate file", c.TLSCertPath),
 	)
 
+	p.publishMetrics()
+	if c.MetricsListenAddr != "" {
+		p.serveMetrics()
+	}
+
+	if c.HTTPListenAddr != "" {
+		p.serveHTTPCache()
+	}
+
 	// TODO: add connection timeouts
 	if err := ssh.ListenAndServe(c.ListenAddr, p.handler, ssh.HostKeyFile(c.HostKeyPath), ssh.PublicKeyAuth(p.auth)); err != nil {
 		p.log.Fatal("Failed to start server", zap.Error(err))
@@ -1,26 +1,23 @@
 package main
 
 import (
-	"context"
 	"io"
-	"os"
-	"os/exec"
-	"sync"
 	"time"
 
 	"github.com/gliderlabs/ssh"
-	"github.com/pkg/errors"
-	"github.com/shurcooL/githubv4"
+	protocol "github.com/input-output-hk/nix-daemon-server/pkg/nix-daemon-protocol"
 	"go.uber.org/zap"
 	xssh "golang.org/x/crypto/ssh"
-	"golang.org/x/oauth2"
 )
 
 type proxy struct {
-	config      *config
-	log         *zap.Logger
-	sessions    chan bool
-	allowedKeys *sync.Map
+	config   *config
+	log      *zap.Logger
+	server   *protocol.Server
+	sessions chan bool
+	github   *githubKeys
+	// sources are asked for a key in order, starting with github.
+	sources []keySource
 }
 
 func (p *proxy) setupLog() {
@@ -65,134 +62,77 @@ func (p *proxy) handler(s ssh.Session) {
 	case <-time.After(p.config.NewConnTime):
 		_, _ = io.WriteString(s.Stderr(), "Too many connections\n")
 		_ = s.Exit(1)
+		return
 	}
 
-	cmd := exec.Command("go", "run", "./pkg/nix-daemon-protocol", "--stdio")
-	cmd.Env = append(os.Environ(),
-		"GITHUB_USER=%s"+s.Context().Value("GITHUB_USER").(string),
-		"SSH_USER=%s"+s.Context().User(),
-		"PUB_KEY_HASH=%s"+xssh.FingerprintSHA256(s.PublicKey()),
-	)
-	cmd.Stderr = s.Stderr()
-	cmd.Stdin = s
-	cmd.Stdout = s
-	if err := cmd.Run(); err != nil {
-		p.log.Error("nix-daemon failed", zap.Error(err), zap.String("state", cmd.ProcessState.String()))
-		_ = s.Exit(1)
+	member := s.Context().Value(memberContextKey{}).(memberWithKey)
+	identity := protocol.Identity{
+		GithubUser:     member.login,
+		KeyUser:        member.principal,
+		SSHUser:        s.User(),
+		KeyFingerprint: xssh.FingerprintSHA256(s.PublicKey()),
+		Teams:          member.teams,
+		Roles:          member.roles,
+		Trusted:        p.config.trusted(member),
 	}
-	p.log.Debug("nix-daemon returned", zap.String("state", cmd.ProcessState.String()))
-	_ = s.Exit(0)
-}
 
-func (p *proxy) auth(ctx ssh.Context, key ssh.PublicKey) bool {
-	allow := false
-	p.allowedKeys.Range(func(_, mk any) bool {
-		if mwk, ok := mk.(memberWithKey); !ok {
-			p.log.DPanic("memberWithKey assertion failed")
-		} else if ssh.KeysEqual(key, mwk.key) {
-			p.log.Info("login allowed", zap.String("login", mwk.login), zap.String("key", xssh.FingerprintSHA256(key)))
-			ctx.SetValue("GITHUB_USER", mwk.login)
-			allow = true
-			return false
+	var err error
+	if command := s.Command(); len(command) > 0 && protocol.IsCommand(command[0]) {
+		if err = p.server.Command(s.Context(), identity, command, s); err != nil {
+			_, _ = io.WriteString(s.Stderr(), "error: "+err.Error()+"\n")
 		}
-
-		return true
-	})
-
-	if !allow {
-		p.log.Info("login denied", zap.String("key", xssh.FingerprintSHA256(key)))
+	} else {
+		err = p.server.Serve(s.Context(), s, identity)
 	}
 
-	return allow
-}
-
-func (p *proxy) syncAllowedKeys() *sync.Map {
-	m := &sync.Map{}
-	if err := p.syncGithub(m); err != nil {
-		p.log.Fatal("initially syncing github", zap.Error(err))
+	if err != nil {
+		p.log.Error("nix-daemon failed", zap.Error(err), zap.String("login", identity.User()), zap.String("key", identity.KeyFingerprint))
+		_ = s.Exit(1)
+		return
 	}
+	p.log.Debug("nix-daemon returned")
+	_ = s.Exit(0)
+}
 
-	go func() {
-		timer := time.Tick(p.config.GHSyncTime)
-		for range timer {
-			if err := p.syncGithub(m); err != nil {
-				p.log.Fatal("while syncing github", zap.Error(err))
-			}
+func (p *proxy) auth(ctx ssh.Context, key ssh.PublicKey) bool {
+	for _, source := range p.sources {
+		if mwk, ok := source.lookup(key); ok {
+			p.log.Info("login allowed", zap.String("login", mwk.name()), zap.Strings("teams", mwk.teams), zap.String("key", xssh.FingerprintSHA256(key)))
+			ctx.SetValue(memberContextKey{}, mwk)
+			return true
 		}
-	}()
+	}
 
-	return m
+	p.log.Info("login denied", zap.String("key", xssh.FingerprintSHA256(key)))
+	return false
 }
 
-// TODO: handle more than 100 members
-type KeyQuery struct {
-	Organization struct {
-		Login githubv4.String
-		Team  struct {
-			Name    githubv4.String
-			Members struct {
-				Nodes []struct {
-					Login      githubv4.String
-					PublicKeys struct {
-						Nodes []struct {
-							Key githubv4.String
-						}
-					} `graphql:"publicKeys(first:100)"`
-				}
-			} `graphql:"members(first:100)"`
-		} `graphql:"team(slug:$team)"`
-	} `graphql:"organization(login:$org)"`
+type memberWithKey struct {
+	// login on GitHub, or principal of a key from a file. Only one is set.
+	login     string
+	principal string
+	key       ssh.PublicKey
+	// teams granted access, as organization/team. Keys from a file have none.
+	teams []string
+	roles []string
 }
 
-func (p *proxy) syncGithub(keys *sync.Map) error {
-	p.log.Debug("fetching github keys")
-	src := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: p.config.Token(p.log)},
-	)
-	httpClient := oauth2.NewClient(context.Background(), src)
-	client := githubv4.NewClient(httpClient)
-
-	query := KeyQuery{}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	if err := client.Query(ctx, &query, map[string]interface{}{
-		"org":  githubv4.String(p.config.GHOrg),
-		"team": githubv4.String(p.config.GHTeam),
-	}); err != nil {
-		return errors.WithMessage(err, "while querying github")
-	}
-
-	seen := map[string]bool{}
-
-	for _, member := range query.Organization.Team.Members.Nodes {
-		login := string(member.Login)
-		for _, key := range member.PublicKeys.Nodes {
-			publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
-			if err != nil {
-				p.log.Error("while parsing key", zap.Error(err))
-			}
-			keyHash := xssh.FingerprintSHA256(publicKey)
-			seen[keyHash] = true
-			_, loaded := keys.LoadOrStore(keyHash, memberWithKey{login, publicKey})
-			if !loaded {
-				p.log.Debug("stored new key", zap.String("key", keyHash), zap.String("login", login))
-			}
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
 		}
 	}
-
-	keys.Range(func(key, value any) bool {
-		if _, ok := seen[key.(string)]; !ok {
-			keys.Delete(key)
-			p.log.Debug("deleted old key", zap.String("key", key.(string)), zap.String("login", value.(memberWithKey).login))
-		}
-		return true
-	})
-
-	return nil
+	return false
 }
 
-type memberWithKey struct {
-	login string
-	key   ssh.PublicKey
+// name is the login, or the principal as key:<principal>.
+func (m memberWithKey) name() string {
+	if m.login == "" {
+		return "key:" + m.principal
+	}
+	return m.login
 }
+
+// memberContextKey holds the memberWithKey a session authenticated as.
+type memberContextKey struct{}
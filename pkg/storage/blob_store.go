@@ -0,0 +1,64 @@
+// Package storage provides the backends NAR data can be kept in.
+package storage
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned for operations on keys that don't exist.
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps opaque blobs under slash separated keys like
+// "nar/<hash>.nar".
+type BlobStore interface {
+	// Put stores everything read from r under key. If reading r fails, the
+	// previous blob under key, if any, is left untouched.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns length bytes of the blob, starting at offset. A negative
+	// length reads until the end.
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+}
+
+// validKey rejects keys with empty, "." or ".." elements, which could refer
+// to blobs outside of the store.
+func validKey(key string) error {
+	for _, element := range strings.Split(key, "/") {
+		if element == "" || element == "." || element == ".." {
+			return errors.Errorf("invalid blob key: %s", key)
+		}
+	}
+	return nil
+}
+
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Open returns the BlobStore described by rawURL. Plain paths and file://
+// URLs are local directories, s3:// URLs are buckets as described in NewS3.
+func Open(rawURL string) (BlobStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while parsing blob store URL")
+	}
+
+	switch u.Scheme {
+	case "":
+		return NewLocal(rawURL), nil
+	case "file":
+		return NewLocal(u.Path), nil
+	case "s3":
+		return NewS3(u)
+	default:
+		return nil, errors.Errorf("unsupported blob store: %s", rawURL)
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Local keeps blobs as files below a directory. Blobs are fanned out into
+// subdirectories named after the first two characters of their name, so
+// "nar/1b8m….nar" ends up at "nar/1b/1b8m….nar".
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+// path returns the file of key. Keys are relative slash separated paths,
+// which can't leave the directory.
+func (l *Local) path(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+
+	dir, name := path.Split(key)
+	fanout := name
+	if len(fanout) > 2 {
+		fanout = fanout[:2]
+	}
+
+	return filepath.Join(l.dir, filepath.FromSlash(dir), fanout, name), nil
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) error {
+	dst, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return errors.WithMessage(err, "while creating blob directory")
+	}
+
+	fd, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return errors.WithMessage(err, "while creating blob file")
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	if _, err := io.Copy(fd, r); err != nil {
+		return errors.WithMessage(err, "while writing blob file")
+	} else if err := fd.Sync(); err != nil {
+		return errors.WithMessage(err, "while syncing blob file")
+	} else if err := fd.Close(); err != nil {
+		return errors.WithMessage(err, "while closing blob file")
+	}
+
+	return errors.WithMessage(os.Rename(fd.Name(), dst), "while renaming blob file")
+}
+
+func (l *Local) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	src, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+			fd.Close()
+			return nil, errors.WithMessage(err, "while seeking blob file")
+		}
+	}
+
+	if length < 0 {
+		return fd, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(fd, length), fd}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	src, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(src); os.IsNotExist(err) {
+		return ErrNotFound
+	} else {
+		return err
+	}
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	src, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &BlobInfo{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
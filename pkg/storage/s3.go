@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+// s3PartSize is how much of an upload is buffered before it's sent as one
+// part of a multipart upload.
+const s3PartSize = 64 << 20
+
+// S3 keeps blobs as objects in an S3 compatible bucket, optionally below a
+// prefix, so multiple servers can share them.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 parses URLs in the style nix uses for S3 binary caches:
+//
+//	s3://bucket/prefix?endpoint=minio.example:9000&region=eu-central-1&scheme=http
+//
+// Credentials are taken from the userinfo of the URL if given, otherwise from
+// the usual AWS_* or MINIO_* environment variables, the AWS credentials file
+// (using the profile parameter) or the instance metadata.
+func NewS3(u *url.URL) (*S3, error) {
+	query := u.Query()
+
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+
+	var creds *credentials.Credentials
+	if u.User != nil {
+		secret, _ := u.User.Password()
+		creds = credentials.NewStaticV4(u.User.Username(), secret, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{Profile: query.Get("profile")},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: query.Get("scheme") != "http",
+		Region: query.Get("region"),
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "while creating S3 client")
+	}
+
+	return &S3{client: client, bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// key returns the object name of key below the prefix. Keys are validated
+// like for Local, so they can't leave the prefix.
+func (s *S3) key(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	return path.Join(s.prefix, key), nil
+}
+
+// Put streams r as a multipart upload. S3 only makes the object visible once
+// the upload completes, and it's aborted if r fails.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) error {
+	name, err := s.key(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(ctx, s.bucket, name, r, -1, minio.PutObjectOptions{
+		PartSize:    s3PartSize,
+		ContentType: "application/octet-stream",
+	})
+	return errors.WithMessagef(err, "while uploading %s", key)
+}
+
+func (s *S3) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	name, err := s.key(key)
+	if err != nil {
+		return nil, err
+	}
+
+	options := minio.GetObjectOptions{}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	} else if length > 0 {
+		if err := options.SetRange(offset, offset+length-1); err != nil {
+			return nil, err
+		}
+	} else if offset > 0 {
+		if err := options.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	// The lazy objects of Client.GetObject drop the range once they're
+	// stat'ed, so the request is made right away instead.
+	object, _, _, err := minio.Core{Client: s.client}.GetObject(ctx, s.bucket, name, options)
+	if err != nil {
+		return nil, s.error(err, key)
+	}
+
+	return object, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	name, err := s.key(key)
+	if err != nil {
+		return err
+	} else if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+
+	return s.error(s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}), key)
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	name, err := s.key(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.error(err, key)
+	}
+
+	return &BlobInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3) error(err error, key string) error {
+	if err == nil {
+		return nil
+	}
+
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrNotFound
+	default:
+		return errors.WithMessagef(err, "s3://%s/%s", s.bucket, path.Join(s.prefix, key))
+	}
+}
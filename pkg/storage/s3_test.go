@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 implements just enough of S3 for the client: multipart uploads,
+// HEAD, ranged GET and DELETE of objects, with path style addressing.
+// Signatures aren't checked.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := r.URL.Path
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err == nil && r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		body, err = decodeAWSChunked(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if !ok || err != nil {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, number))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		numbers := []int{}
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		object := []byte{}
+		for _, number := range numbers {
+			object = append(object, parts[number]...)
+		}
+		f.objects[name] = object
+		delete(f.uploads, query.Get("uploadId"))
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string   `xml:"Bucket"`
+			Key     string   `xml:"Key"`
+			ETag    string   `xml:"ETag"`
+		}{Bucket: bucket, Key: key, ETag: `"object"`})
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				writeXML(w, struct {
+					XMLName xml.Name `xml:"Error"`
+					Code    string   `xml:"Code"`
+				}{Code: "NoSuchKey"})
+			}
+			return
+		}
+		w.Header().Set("ETag", `"object"`)
+		http.ServeContent(w, r, name, time.Unix(1670000000, 0), bytes.NewReader(object))
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+// decodeAWSChunked strips the signed chunks of streaming uploads, which are
+// <hex size>;chunk-signature=<signature>\r\n<data>\r\n up to an empty one.
+func decodeAWSChunked(body []byte) ([]byte, error) {
+	decoded := []byte{}
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, errors.New("truncated aws-chunked body")
+		}
+		size, _, _ := bytes.Cut(header, []byte(";"))
+		n, err := strconv.ParseInt(string(size), 16, 64)
+		if err != nil || int64(len(rest)) < n+2 {
+			return nil, errors.New("invalid aws-chunked body")
+		} else if n == 0 {
+			return decoded, nil
+		}
+		decoded = append(decoded, rest[:n]...)
+		body = rest[n+2:]
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func newTestS3(t *testing.T) (*S3, *fakeS3) {
+	t.Helper()
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse("s3://key:secret@bucket/some/prefix?scheme=http&region=us-east-1&endpoint=" + strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3, err := NewS3(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3, fake
+}
+
+func TestS3(t *testing.T) {
+	ctx := context.Background()
+	s3, fake := newTestS3(t)
+	contents := "nix-archive-1 but not really"
+
+	if err := s3.Put(ctx, "nar/abc.nar", strings.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	} else if _, ok := fake.objects["/bucket/some/prefix/nar/abc.nar"]; !ok {
+		t.Fatalf("object isn't below the prefix: %v", fake.objects)
+	}
+
+	for _, key := range []string{"", "nar/../../other/abc.nar", "./nar/abc.nar", "nar//abc.nar"} {
+		if _, err := s3.Stat(ctx, key); err == nil || err == ErrNotFound {
+			t.Errorf("Stat(%q): got %v, want an invalid key", key, err)
+		}
+	}
+
+	if info, err := s3.Stat(ctx, "nar/abc.nar"); err != nil {
+		t.Fatal(err)
+	} else if info.Size != int64(len(contents)) {
+		t.Errorf("got size %d, want %d", info.Size, len(contents))
+	}
+
+	reads := []struct {
+		offset, length int64
+		want           string
+	}{
+		{offset: 0, length: -1, want: contents},
+		{offset: 4, length: -1, want: contents[4:]},
+		{offset: 4, length: 7, want: contents[4:11]},
+		{offset: 4, length: 0, want: ""},
+	}
+	for _, read := range reads {
+		blob, err := s3.Get(ctx, "nar/abc.nar", read.offset, read.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(blob)
+		blob.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != read.want {
+			t.Errorf("Get(%d, %d) = %q, want %q", read.offset, read.length, got, read.want)
+		}
+	}
+
+	if err := s3.Delete(ctx, "nar/abc.nar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.Stat(ctx, "nar/abc.nar"); err != ErrNotFound {
+		t.Errorf("Stat after Delete: got %v, want ErrNotFound", err)
+	}
+	if _, err := s3.Get(ctx, "nar/abc.nar", 0, -1); err != ErrNotFound {
+		t.Errorf("Get after Delete: got %v, want ErrNotFound", err)
+	}
+	if err := s3.Delete(ctx, "nar/abc.nar"); err != ErrNotFound {
+		t.Errorf("Delete after Delete: got %v, want ErrNotFound", err)
+	}
+}